@@ -0,0 +1,387 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"io"
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	binaryMagic = []byte("GPMB")
+)
+
+// maxBinaryRecord bounds the allocation of a corrupted length prefix.
+const maxBinaryRecord = 1 << 30
+
+// jsonPartSnapshot is the state of a partition written by flush.
+type jsonPartSnapshot struct {
+	dropQueue        []DropPlan
+	parquetSizeBytes int64
+	rowCount         int64
+	minTime          int64
+	maxTime          int64
+	walSeq           uint64
+	merges           []jsonMergeLease
+	moves            []jsonMoveLease
+	commits          []string
+	entries          []*jsonIndexEntry
+}
+
+// encode writes the partition file with the codec of the index.
+func (J *jsonPartIndex) encode(w io.Writer, s *jsonPartSnapshot) error {
+	switch J.options.Codec {
+	case CodecGzip:
+		gz := gzip.NewWriter(w)
+		if err := J.writeJSON(gz, s); err != nil {
+			return err
+		}
+		return gz.Close()
+	case CodecBinary:
+		return J.writeBinary(w, s)
+	}
+	return J.writeJSON(w, s)
+}
+
+// decode reads a partition file of any codec, told apart by its first bytes,
+// and returns its format version.
+func (J *jsonPartIndex) decode(r *bufio.Reader) (int, error) {
+	magic, _ := r.Peek(len(binaryMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		return J.readJSON(gz)
+	case bytes.Equal(magic, binaryMagic):
+		return J.readBinary(r)
+	}
+	return J.readJSON(r)
+}
+
+// writeHeader writes the fields of the partition but the files.
+func (J *jsonPartIndex) writeHeader(stream *jsoniter.Stream, s *jsonPartSnapshot) error {
+	stream.WriteObjectField("type")
+	stream.WriteString(J.table)
+
+	stream.WriteMore()
+	stream.WriteObjectField("version")
+	stream.WriteInt(jsonFormatVersion)
+
+	stream.WriteMore()
+	stream.WriteObjectField("parquet_size_bytes")
+	stream.WriteInt64(s.parquetSizeBytes)
+
+	stream.WriteMore()
+	stream.WriteObjectField("row_count")
+	stream.WriteInt64(s.rowCount)
+
+	stream.WriteMore()
+	stream.WriteObjectField("min_time")
+	stream.WriteInt64(s.minTime)
+
+	stream.WriteMore()
+	stream.WriteObjectField("max_time")
+	stream.WriteInt64(s.maxTime)
+
+	stream.WriteMore()
+	stream.WriteObjectField("wal_sequence")
+	stream.WriteUint64(s.walSeq)
+
+	stream.WriteMore()
+	stream.WriteObjectField("drop_queue")
+	stream.WriteArrayStart()
+	for i, d := range s.dropQueue {
+		if i > 0 {
+			stream.WriteMore()
+		}
+		strD, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		stream.WriteRaw(string(strD))
+	}
+	stream.WriteArrayEnd()
+
+	stream.WriteMore()
+	stream.WriteObjectField("merges")
+	stream.WriteVal(s.merges)
+	stream.WriteMore()
+	stream.WriteObjectField("moves")
+	stream.WriteVal(s.moves)
+	stream.WriteMore()
+	stream.WriteObjectField("commits")
+	stream.WriteVal(s.commits)
+	return stream.Error
+}
+
+func (J *jsonPartIndex) writeJSON(w io.Writer, s *jsonPartSnapshot) error {
+	stream := jsoniter.NewStream(jsoniter.ConfigDefault, w, 4096)
+	stream.WriteObjectStart()
+	if err := J.writeHeader(stream, s); err != nil {
+		return err
+	}
+
+	stream.WriteMore()
+	stream.WriteObjectField("files")
+	stream.WriteArrayStart()
+	for i, entry := range s.entries {
+		if i > 0 {
+			stream.WriteMore()
+		}
+		stream.WriteRaw(entry._marshalled)
+	}
+	stream.WriteArrayEnd()
+	stream.WriteObjectEnd()
+
+	if stream.Error != nil {
+		return stream.Error
+	}
+	return stream.Flush()
+}
+
+// readJSON reads a metadata.json document and returns its format version.
+func (J *jsonPartIndex) readJSON(r io.Reader) (int, error) {
+	version := 0
+	var err error
+	iter := jsoniter.Parse(J.jsonConfig(), r, 4096)
+	iter.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
+		switch s {
+		case "version":
+			version = iterator.ReadInt()
+		case "drop_queue":
+			for iterator.ReadArray() {
+				var dropQueueEntry DropPlan
+				iterator.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
+					if k, ok := jsonLegacyDropKeys[s]; ok && version == 0 {
+						s = k
+					}
+					switch s {
+					case "id":
+						dropQueueEntry.ID = iterator.ReadString()
+					case "writer_id":
+						dropQueueEntry.WriterID = iterator.ReadString()
+					case "layer":
+						dropQueueEntry.Layer = iterator.ReadString()
+					case "database":
+						dropQueueEntry.Database = iterator.ReadString()
+					case "table":
+						dropQueueEntry.Table = iterator.ReadString()
+					case "path":
+						dropQueueEntry.Path = iterator.ReadString()
+					case "time_s":
+						dropQueueEntry.TimeS = iterator.ReadInt32()
+					default:
+						return J.skipUnknown(iterator, "drop_queue."+s)
+					}
+					return true
+				})
+				J.dropQueue = append(J.dropQueue, dropQueueEntry)
+			}
+		case "type":
+			iterator.Skip()
+		case "parquet_size_bytes":
+			J.parquetSizeBytes = iterator.ReadInt64()
+		case "row_count":
+			J.rowCount = iterator.ReadInt64()
+		case "min_time":
+			J.minTime = iterator.ReadInt64()
+		case "max_time":
+			J.maxTime = iterator.ReadInt64()
+		case "wal_sequence":
+			J.walSeq = iterator.ReadUint64()
+		case "merges":
+			var merges []jsonMergeLease
+			iterator.ReadVal(&merges)
+			for _, l := range merges {
+				J.setMerge(l)
+			}
+		case "moves":
+			var moves []jsonMoveLease
+			iterator.ReadVal(&moves)
+			for _, l := range moves {
+				J.setMove(l)
+			}
+		case "commits":
+			for iterator.ReadArray() {
+				J.commits[iterator.ReadString()] = true
+			}
+		case "files":
+			err = J.populateFiles(iterator)
+			if err != nil {
+				return false
+			}
+		default:
+			return J.skipUnknown(iterator, s)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version, iter.Error
+}
+
+// writeBinary writes the magic, the JSON header and a record per entry, each
+// prefixed with its length.
+func (J *jsonPartIndex) writeBinary(w io.Writer, s *jsonPartSnapshot) error {
+	var header bytes.Buffer
+	stream := jsoniter.NewStream(jsoniter.ConfigDefault, &header, 4096)
+	stream.WriteObjectStart()
+	if err := J.writeHeader(stream, s); err != nil {
+		return err
+	}
+	stream.WriteObjectEnd()
+	if err := stream.Flush(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(binaryMagic)
+	bw.Write(binary.AppendUvarint(nil, uint64(header.Len())))
+	bw.Write(header.Bytes())
+	var rec, size []byte
+	for _, e := range s.entries {
+		var err error
+		if rec, err = appendBinaryEntry(rec[:0], e); err != nil {
+			return err
+		}
+		size = binary.AppendUvarint(size[:0], uint64(len(rec)))
+		bw.Write(size)
+		if _, err = bw.Write(rec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (J *jsonPartIndex) readBinary(r *bufio.Reader) (int, error) {
+	r.Discard(len(binaryMagic))
+	readRecord := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxBinaryRecord {
+			return nil, fmt.Errorf("invalid record length %d", n)
+		}
+		rec := make([]byte, n)
+		if _, err = io.ReadFull(r, rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	header, err := readRecord()
+	if err != nil {
+		return 0, err
+	}
+	version, err := J.readJSON(bytes.NewReader(header))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		rec, err := readRecord()
+		if err == io.EOF {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		e, err := J.decodeBinaryEntry(rec)
+		if err != nil {
+			return 0, err
+		}
+		if err = J.loadEntry(e); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// appendBinaryEntry encodes the fields of the entry in a fixed order: the
+// strings and the column statistics (as JSON) prefixed with their length,
+// the numbers as varints.
+func appendBinaryEntry(b []byte, e *jsonIndexEntry) ([]byte, error) {
+	appendBytes := func(b []byte, s []byte) []byte {
+		return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+	}
+	b = binary.AppendUvarint(b, uint64(e.Id))
+	for _, s := range []string{e.Layer, e.Database, e.Table, e.Path, e.WriterID, e.Range, e.Type} {
+		b = appendBytes(b, []byte(s))
+	}
+	for _, n := range []int64{e.SizeBytes, e.RowCount, e.ChunkTime, e.MinTime, e.MaxTime} {
+		b = binary.AppendVarint(b, n)
+	}
+	for _, m := range []map[string]any{e.Min, e.Max} {
+		var raw []byte
+		if m != nil {
+			var err error
+			if raw, err = json.Marshal(m); err != nil {
+				return nil, err
+			}
+		}
+		b = appendBytes(b, raw)
+	}
+	return b, nil
+}
+
+// decodeBinaryEntry reads a record of appendBinaryEntry. The bytes after the
+// known fields come from a newer version: they are ignored, or rejected in
+// strict mode.
+func (J *jsonPartIndex) decodeBinaryEntry(rec []byte) (*jsonIndexEntry, error) {
+	var err error
+	uvarint := func() uint64 {
+		n, l := binary.Uvarint(rec)
+		if l <= 0 {
+			err = io.ErrUnexpectedEOF
+			return 0
+		}
+		rec = rec[l:]
+		return n
+	}
+	varint := func() int64 {
+		n, l := binary.Varint(rec)
+		if l <= 0 {
+			err = io.ErrUnexpectedEOF
+			return 0
+		}
+		rec = rec[l:]
+		return n
+	}
+	prefixed := func() []byte {
+		n := uvarint()
+		if err != nil || n > uint64(len(rec)) {
+			err = io.ErrUnexpectedEOF
+			return nil
+		}
+		res := rec[:n]
+		rec = rec[n:]
+		return res
+	}
+	e := &jsonIndexEntry{}
+	e.Id = uint32(uvarint())
+	for _, s := range []*string{&e.Layer, &e.Database, &e.Table, &e.Path, &e.WriterID, &e.Range, &e.Type} {
+		*s = string(prefixed())
+	}
+	for _, n := range []*int64{&e.SizeBytes, &e.RowCount, &e.ChunkTime, &e.MinTime, &e.MaxTime} {
+		*n = varint()
+	}
+	for _, m := range []*map[string]any{&e.Min, &e.Max} {
+		if raw := prefixed(); len(raw) > 0 && err == nil {
+			err = json.Unmarshal(raw, m)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rec) > 0 && J.options.StrictFormat {
+		return nil, fmt.Errorf("%s: %d unknown bytes", e.Path, len(rec))
+	}
+	return e, nil
+}
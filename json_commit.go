@@ -0,0 +1,155 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const commitDirName = "commits"
+
+// jsonCommitRecord is a Batch spanning several partitions. It is written to
+// <layer>/<db>/<table>/commits, under the first layer, before any partition
+// is changed and removed once every partition has it. Each partition marks
+// the records it applied with their id, the file name. A record left by a
+// crash or a failed Batch is applied again when the table is opened, to the
+// partitions without its mark: the Batch ends up in all of its partitions,
+// or in none if the crash came before the record was complete.
+type jsonCommitRecord struct {
+	Add []*IndexEntry `json:"add"`
+	Rm  []*IndexEntry `json:"rm"`
+}
+
+// commitDir is under the first layer stored on disk, "" if there is none.
+func (J *JSONIndex) commitDir() string {
+	return jsonCommitDir(J.layers, J.database, J.table)
+}
+
+func jsonCommitDir(layers []jsonLayer, database string, table string) string {
+	for _, l := range layers {
+		if l.Path != "" {
+			return path.Join(l.Path, database, table, commitDirName)
+		}
+	}
+	return ""
+}
+
+// beginCommit writes the record of the Batch and returns its id. It is
+// written to a .tmp file and renamed once complete, and stays locked until
+// end: the recovery of another process waits for it.
+func (J *JSONIndex) beginCommit(add []*IndexEntry, rm []*IndexEntry) (string, func(err error) error, error) {
+	dir := J.commitDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(jsonCommitRecord{Add: add, Rm: rm})
+	if err != nil {
+		return "", nil, err
+	}
+	id := uuid.New().String()
+	name := path.Join(dir, id)
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o644)
+	if err != nil {
+		return "", nil, err
+	}
+	fail := func(err error) (string, func(error) error, error) {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return "", nil, err
+	}
+	if err = flock(f); err != nil {
+		return fail(err)
+	}
+	if _, err = f.Write(data); err != nil {
+		return fail(err)
+	}
+	durable := J.options.Durability != DurabilityNone
+	if durable {
+		if err = f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err = os.Rename(name+".tmp", name+".json"); err != nil {
+		return fail(err)
+	}
+	if durable {
+		if err = syncDir(dir); err != nil {
+			f.Close()
+			return "", nil, err
+		}
+	}
+	// A failed Batch keeps its record, it is applied again on recovery
+	return id, func(err error) error {
+		defer f.Close()
+		if err != nil {
+			return err
+		}
+		return os.Remove(name + ".json")
+	}, nil
+}
+
+// recoverCommits applies the records of the Batches interrupted by a crash
+// and removes the incomplete ones.
+func (J *JSONIndex) recoverCommits() error {
+	if J.commitDir() == "" {
+		return nil
+	}
+	files, err := os.ReadDir(J.commitDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := filepath.Join(J.commitDir(), file.Name())
+		if err := J.recoverCommit(name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (J *JSONIndex) recoverCommit(name string) error {
+	if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".tmp") {
+		return nil
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The writer holds the lock until the record is removed
+	if err = flock(f); err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if cur, err := os.Stat(name); err != nil || !os.SameFile(st, cur) {
+		// Done in the meantime
+		return nil
+	}
+	if strings.HasSuffix(name, ".tmp") {
+		return os.Remove(name)
+	}
+	var rec jsonCommitRecord
+	if err = json.NewDecoder(f).Decode(&rec); err != nil {
+		return err
+	}
+	J.lock.Lock()
+	applied := J.apply(rec.Add, rec.Rm, strings.TrimSuffix(filepath.Base(name), ".json"), true)
+	J.lock.Unlock()
+	if _, err = applied.Get(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
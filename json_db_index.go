@@ -1,11 +1,11 @@
 package metadata
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 )
 
 type jsonDBIndex struct {
@@ -23,8 +23,15 @@ func NewJSONDBIndex(layers []Layer) DBIndex {
 }
 
 func (j *jsonDBIndex) Databases() ([]string, error) {
+	return j.DatabasesCtx(context.Background())
+}
+
+func (j *jsonDBIndex) DatabasesCtx(ctx context.Context) ([]string, error) {
 	res := map[string]bool{}
 	for _, l := range j.layers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		ents, err := os.ReadDir(path.Join(l.Path))
 		if errors.Is(err, os.ErrNotExist) {
 			continue
@@ -46,8 +53,15 @@ func (j *jsonDBIndex) Databases() ([]string, error) {
 }
 
 func (j *jsonDBIndex) Tables(database string) ([]string, error) {
+	return j.TablesCtx(context.Background(), database)
+}
+
+func (j *jsonDBIndex) TablesCtx(ctx context.Context, database string) ([]string, error) {
 	res := map[string]bool{}
 	for _, l := range j.layers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		ents, err := os.ReadDir(path.Join(l.Path, database))
 		if errors.Is(err, os.ErrNotExist) {
 			continue
@@ -69,19 +83,32 @@ func (j *jsonDBIndex) Tables(database string) ([]string, error) {
 }
 
 func (j *jsonDBIndex) Paths(database string, table string) ([]string, error) {
+	return j.PathsCtx(context.Background(), database, table)
+}
+
+func (j *jsonDBIndex) PathsCtx(ctx context.Context, database string, table string) ([]string, error) {
 	res := map[string]bool{}
 	for _, l := range j.layers {
 		root := path.Join(l.Path, database, table)
-		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if info == nil || !info.IsDir() {
 				return nil
 			}
-			if strings.HasPrefix(info.Name(), "hour=") {
-				res[path[len(root)+1:]] = true
-				return filepath.SkipDir
+			// The partition layout is per table, its directories hold the index
+			for _, name := range []string{"metadata.json", walFileName} {
+				if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+					res[path[len(root)+1:]] = true
+					return filepath.SkipDir
+				}
 			}
 			return nil
 		})
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
 	}
 	_res := make([]string, 0, len(res))
 	for k := range res {
@@ -1,14 +1,27 @@
 package metadata
 
-import "path"
+import (
+	"context"
+	"path"
+)
 
 func (J *JSONIndex) GetDropQueue(writerId string, layer string) (DropPlan, error) {
-	parts := J.parts[layer]
-	if parts == nil {
-		return DropPlan{}, nil
+	return J.GetDropQueueCtx(context.Background(), writerId, layer)
+}
+
+func (J *JSONIndex) GetDropQueueCtx(ctx context.Context, writerId string, layer string) (DropPlan, error) {
+	J.lock.Lock()
+	defer J.lock.Unlock()
+	dirs, err := J.plannedDirs(layer, writerId, func(w *jsonWriterDue) int64 { return w.Drop })
+	if err != nil {
+		return DropPlan{}, err
 	}
-	for _, idx := range parts {
-		p, err := idx.GetDropPlanner().GetDropQueue(writerId, layer)
+	for _, dir := range dirs {
+		idx, err := J.populate(layer, dir)
+		if err != nil {
+			return DropPlan{}, err
+		}
+		p, err := idx.GetDropQueueCtx(ctx, writerId, layer)
 		if err != nil {
 			return DropPlan{}, err
 		}
@@ -24,14 +37,25 @@ func (J *JSONIndex) GetDropPlanner() TableDropPlanner {
 }
 
 func (J *JSONIndex) RmFromDropQueue(plan DropPlan) Promise[int32] {
-	l := J.parts[plan.Layer]
-	if l == nil {
-		return Fulfilled(nil, int32(0))
+	return J.RmFromDropQueueCtx(context.Background(), plan)
+}
+
+func (J *JSONIndex) RmFromDropQueueCtx(ctx context.Context, plan DropPlan) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
 	}
+	J.lock.Lock()
+	defer J.lock.Unlock()
 	dir := path.Dir(plan.Path)
-	part := l[dir]
+	part := J.parts[plan.Layer][dir]
+	if part == nil && J.options.boundedCache() {
+		var err error
+		if part, err = J.populate(plan.Layer, dir); err != nil {
+			return Fulfilled(err, int32(0))
+		}
+	}
 	if part != nil {
-		return part.RmFromDropQueue(plan)
+		return part.RmFromDropQueueCtx(ctx, plan)
 	}
 	return Fulfilled(nil, int32(0))
 }
@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsonFormatVersion is the version of metadata.json written by flush. The
+// files without a version field are version 0.
+const jsonFormatVersion = 4
+
+// jsonMigrations[v] upgrades a partition read from a version v file. They
+// run in populate, before the write-ahead log is replayed, and the upgraded
+// partition is written with the next flush.
+var jsonMigrations = []func(J *jsonPartIndex) error{
+	// 0: the totals double counted the replaced files, they are recomputed
+	func(J *jsonPartIndex) error {
+		J.parquetSizeBytes = 0
+		J.rowCount = 0
+		for _, it := range J.iterations {
+			J.parquetSizeBytes += it.SizeBytes
+			J.rowCount += it.RowCount
+		}
+		J.recalcMin()
+		J.recalcMax()
+		// and the drop plans were written without an ID
+		for i := range J.dropQueue {
+			if J.dropQueue[i].ID == "" {
+				J.dropQueue[i].ID = uuid.New().String()
+			}
+		}
+		return nil
+	},
+	// 1: the move leases are new, there is nothing to upgrade
+	func(J *jsonPartIndex) error {
+		return nil
+	},
+	// 2: the merge leases are new
+	func(J *jsonPartIndex) error {
+		return nil
+	},
+	// 3: the commit markers are new
+	func(J *jsonPartIndex) error {
+		return nil
+	},
+}
+
+// jsonLegacyDropKeys are the drop plan keys of the version 0 files, written
+// by json.Marshal before DropPlan had tags.
+var jsonLegacyDropKeys = map[string]string{
+	"ID":       "id",
+	"WriterID": "writer_id",
+	"Layer":    "layer",
+	"Database": "database",
+	"Table":    "table",
+	"Path":     "path",
+	"TimeS":    "time_s",
+}
+
+// strictJSON rejects the unknown fields of the file entries.
+var strictJSON = jsoniter.Config{EscapeHTML: true, DisallowUnknownFields: true}.Froze()
+
+func (J *jsonPartIndex) jsonConfig() jsoniter.API {
+	if J.options.StrictFormat {
+		return strictJSON
+	}
+	return jsoniter.ConfigDefault
+}
+
+// skipUnknown skips a field populate does not know, or fails in strict mode.
+func (J *jsonPartIndex) skipUnknown(iter *jsoniter.Iterator, field string) bool {
+	if J.options.StrictFormat {
+		iter.ReportError("populate", fmt.Sprintf("unknown field \"%s\"", field))
+		return false
+	}
+	iter.Skip()
+	return true
+}
+
+func (J *jsonPartIndex) migrate(version int) error {
+	if version > jsonFormatVersion {
+		return fmt.Errorf("%s: format version %d is newer than %d, upgrade gigapi",
+			J.idxPath, version, jsonFormatVersion)
+	}
+	for v := version; v < jsonFormatVersion; v++ {
+		if err := jsonMigrations[v](J); err != nil {
+			return fmt.Errorf("%s: migration from version %d: %w", J.idxPath, v, err)
+		}
+	}
+	return nil
+}
@@ -1,12 +1,15 @@
 package metadata
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"io/fs"
+	"iter"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -35,111 +38,471 @@ type JSONIndex struct {
 	lock     sync.Mutex
 	parts    map[string]map[string]*jsonPartIndex
 	layers   []jsonLayer
+	options  IndexOptions
+	// loaded partitions, most recently used first
+	lru *list.List
+	// evicted partitions being written, by layer and dir
+	evicted map[[2]string]chan struct{}
+	// manifests lists the partitions of each layer
+	manifests map[string]*jsonManifest
+	// seq numbers the changes applied to the partitions, readers counts the
+	// open readers by the change they started at and keeping are the
+	// partitions holding views for them. Under lock.
+	seq     uint64
+	readers map[uint64]int
+	keeping map[*jsonPartIndex]bool
+
+	stop context.CancelFunc
+	done chan struct{}
 }
 
 func NewJSONIndex(root string, database string, table string, layers []Layer) (TableIndex, error) {
+	return NewJSONIndexWithOptions(root, database, table, layers, IndexOptions{})
+}
+
+func NewJSONIndexWithOptions(root string, database string, table string, layers []Layer,
+	options IndexOptions) (TableIndex, error) {
 	var jLayers []jsonLayer
 	for _, layer := range layers {
 		jLayers = append(jLayers, layer2JsonLayer(layer))
 	}
 	res := &JSONIndex{
-		root:     root,
-		database: database,
-		table:    table,
-		parts:    map[string]map[string]*jsonPartIndex{},
-		layers:   jLayers,
+		root:      root,
+		database:  database,
+		table:     table,
+		parts:     map[string]map[string]*jsonPartIndex{},
+		layers:    jLayers,
+		options:   options,
+		lru:       list.New(),
+		evicted:   make(map[[2]string]chan struct{}),
+		manifests: make(map[string]*jsonManifest),
+		readers:   make(map[uint64]int),
+		keeping:   make(map[*jsonPartIndex]bool),
 	}
 	for _, layer := range jLayers {
-		prefix := filepath.Join(layer.Path, database, table, "data")
-		err := filepath.Walk(prefix, func(path string, info fs.FileInfo, err error) error {
-			if info == nil {
-				return nil
-			}
-			if !info.IsDir() {
-				return nil
+		if layer.Path == "" {
+			continue
+		}
+		m, err := res.openManifest(layer)
+		if err != nil {
+			return nil, err
+		}
+		if options.boundedCache() {
+			continue
+		}
+		dirs, err := m.dirs(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if _, err := res.populate(layer.Name, dir); err != nil {
+				return nil, err
 			}
-			metadataPath := filepath.Join(path, "metadata.json")
-			if _, err := os.Stat(metadataPath); !os.IsNotExist(err) {
-				_, err := res.populate(layer.Name, path[len(prefix)+1:])
-				if err != nil {
-					return err
-				}
+		}
+	}
+	if err := res.recoverCommits(); err != nil {
+		res.Stop()
+		return nil, err
+	}
+	return res, nil
+}
+
+// openManifest reads the manifest of the layer, or rebuilds it from the
+// partition directories if there is none.
+func (J *JSONIndex) openManifest(layer jsonLayer) (*jsonManifest, error) {
+	dir := filepath.Join(layer.Path, J.database, J.table, "data")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := newJsonManifest(dir)
+	m.m.Lock()
+	err := m.sync()
+	m.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// The partitions evicted during a rebuild are summed up in it
+	J.manifests[layer.Name] = m
+	if m.diskInfo != nil {
+		return m, nil
+	}
+	dirs, err := J.listPartitions(context.Background(), layer)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		stamp := time.Now().UnixNano()
+		p, err := J.populate(layer.Name, d)
+		if err != nil {
+			return nil, err
+		}
+		m.m.Lock()
+		J.list(m, p)
+		m.sumDue(d, p.planDue(stamp))
+		m.m.Unlock()
+	}
+	return m, m.save(J.options.Durability != DurabilityNone)
+}
+
+// listPartitions walks the layer for the partition directories holding a
+// metadata.json or a write-ahead log.
+func (J *JSONIndex) listPartitions(ctx context.Context, layer jsonLayer) ([]string, error) {
+	if layer.Path == "" {
+		return nil, nil
+	}
+	var res []string
+	prefix := filepath.Join(layer.Path, J.database, J.table, "data")
+	err := filepath.Walk(prefix, func(path string, info fs.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info == nil {
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		for _, name := range []string{"metadata.json", walFileName} {
+			if _, err := os.Stat(filepath.Join(path, name)); !os.IsNotExist(err) {
+				res = append(res, filepath.ToSlash(path[len(prefix)+1:]))
 				return filepath.SkipDir
 			}
-			return nil
-		})
+		}
+		return nil
+	})
+	return res, err
+}
+
+// partitionDirs returns the sorted partitions of the layer. Without a cache
+// bound every partition is loaded, otherwise the manifest is read too.
+// Runs under J.lock.
+func (J *JSONIndex) partitionDirs(ctx context.Context, layer string) ([]string, error) {
+	var res []string
+	for dir := range J.parts[layer] {
+		res = append(res, dir)
+	}
+	if m := J.manifests[layer]; m != nil && J.options.boundedCache() {
+		dirs, err := m.dirs(nil, nil)
 		if err != nil {
 			return nil, err
 		}
+		res = append(res, dirs...)
+	}
+	slices.Sort(res)
+	return slices.Compact(res), nil
+}
+
+// plannedDirs returns the sorted partitions the planners of the writer look
+// into: the loaded ones and, with a cache bound, the ones the manifest has
+// work due for, the time of which due picks. Runs under J.lock.
+func (J *JSONIndex) plannedDirs(layer string, writerId string, due func(w *jsonWriterDue) int64) ([]string, error) {
+	var res []string
+	for dir := range J.parts[layer] {
+		res = append(res, dir)
+	}
+	if m := J.manifests[layer]; m != nil && J.options.boundedCache() {
+		dirs, err := m.dueDirs(writerId, due, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, dirs...)
+	}
+	slices.Sort(res)
+	return slices.Compact(res), nil
+}
+
+// evict unloads the least recently used partitions until the cache fits its
+// bounds. The most recent partition and the ones with plans in progress
+// stay. The evicted partitions are written in the background. Runs under
+// J.lock.
+func (J *JSONIndex) evict() {
+	if !J.options.boundedCache() {
+		return
+	}
+	for key, done := range J.evicted {
+		select {
+		case <-done:
+			delete(J.evicted, key)
+		default:
+		}
+	}
+	var size int64
+	for e := J.lru.Front(); e != nil; e = e.Next() {
+		size += e.Value.(*jsonPartIndex).memBytes.Load()
+	}
+	over := func() bool {
+		return (J.options.MaxCachedPartitions > 0 && J.lru.Len() > J.options.MaxCachedPartitions) ||
+			(J.options.MaxCachedBytes > 0 && size > J.options.MaxCachedBytes)
+	}
+	for e := J.lru.Back(); e != nil && e != J.lru.Front() && over(); {
+		prev := e.Prev()
+		idx := e.Value.(*jsonPartIndex)
+		// The views kept for the readers are lost with the partition
+		if !idx.pinned && !J.keeping[idx] {
+			size -= idx.memBytes.Load()
+			J.lru.Remove(e)
+			delete(J.parts[idx.layer], idx.partPath)
+			done := make(chan struct{})
+			J.evicted[[2]string{idx.layer, idx.partPath}] = done
+			go J.unload(idx, J.manifests[idx.layer], done)
+		}
+		e = prev
+	}
+}
+
+// unload stops an evicted partition and sums it up in the manifest.
+func (J *JSONIndex) unload(idx *jsonPartIndex, m *jsonManifest, done chan struct{}) {
+	defer close(done)
+	J.sumUp(idx, m)
+	m.m.Lock()
+	dirty := m.dirty
+	m.m.Unlock()
+	if !dirty {
+		return
+	}
+	if err := m.save(J.options.Durability != DurabilityNone); err != nil {
+		J.options.onError(fmt.Errorf("saving the manifest of %s: %w", idx.layer, err))
+	}
+}
+
+// sumUp stops the partition and brings its totals and the work of its
+// planners in the manifest of its layer.
+func (J *JSONIndex) sumUp(idx *jsonPartIndex, m *jsonManifest) {
+	// The summary holds the changes written before the partition is read
+	// again
+	stamp := time.Now().UnixNano()
+	idx.Stop()
+	err := idx.refresh()
+	m.m.Lock()
+	defer m.m.Unlock()
+	J.list(m, idx)
+	if err == nil {
+		m.sumDue(idx.partPath, idx.planDue(stamp))
 	}
-	return res, nil
+}
+
+// list records the totals of the partition in the manifest, or removes it
+// once it holds no file and no work for the planners: emptied, or its
+// directory gone. Runs under m.m.
+func (J *JSONIndex) list(m *jsonManifest, idx *jsonPartIndex) {
+	if idx.idle() {
+		m.drop(idx.partPath)
+		return
+	}
+	m.set(idx.partPath, idx.partitionStats(), J.options.partitionScheme())
 }
 
 func (J *JSONIndex) GetQuerier() TableQuerier {
 	return J
 }
 
+func (J *JSONIndex) GetStats() TableStats {
+	return J
+}
+
+func (J *JSONIndex) Stats() ([]*LayerStats, error) {
+	return J.StatsCtx(context.Background())
+}
+
+// StatsCtx sums the counters kept by the partitions, no entry is read.
+func (J *JSONIndex) StatsCtx(ctx context.Context) ([]*LayerStats, error) {
+	var stats []*PartitionStats
+	for v, err := range J.snapshot(ctx, nil) {
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, v.stats)
+	}
+	var layers []string
+	for _, l := range J.layers {
+		layers = append(layers, l.Name)
+	}
+	return layerStats(layers, stats), nil
+}
+
 func (J *JSONIndex) GetAll() ([]*IndexEntry, error) {
-	var res []*IndexEntry
-	for _, l := range J.parts {
-		for _, parts := range l {
-			_res, err := parts.GetAll()
+	return J.GetAllCtx(context.Background())
+}
+
+func (J *JSONIndex) GetAllCtx(ctx context.Context) ([]*IndexEntry, error) {
+	return collectEntries(J.GetAllIter(ctx))
+}
+
+func (J *JSONIndex) GetAllIter(ctx context.Context) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		for v, err := range J.snapshot(ctx, nil) {
 			if err != nil {
-				return nil, err
+				yield(nil, err)
+				return
+			}
+			for _, e := range v.entries {
+				if !yield(&e.IndexEntry, nil) {
+					return
+				}
 			}
-			res = append(res, _res...)
 		}
 	}
-	return res, nil
+}
+
+func (J *JSONIndex) load(layer string, dir string) (*jsonPartIndex, error) {
+	J.lock.Lock()
+	defer J.lock.Unlock()
+	return J.populate(layer, dir)
 }
 
 func (J *JSONIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return J.BatchCtx(context.Background(), add, rm)
+}
+
+// BatchCtx checks ctx before the batch is applied. Once the entries are handed
+// to the partition flushers the write completes regardless of ctx. A batch
+// spanning several partitions is written to a commit record first.
+func (J *JSONIndex) BatchCtx(ctx context.Context, add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
 	J.lock.Lock()
 	defer J.lock.Unlock()
-	addByLayer := make(map[string][]*IndexEntry)
-	rmByLayer := make(map[string][]*IndexEntry)
-	layers := make(map[string]bool)
-	for _, entry := range add {
-		addByLayer[entry.Layer] = append(addByLayer[entry.Layer], entry)
-		layers[entry.Layer] = true
+	parts := make(map[[2]string]bool)
+	for _, e := range slices.Concat(add, rm) {
+		if J.manifests[e.Layer] == nil {
+			// Checked upfront, a batch is applied whole or not at all
+			return Fulfilled(fmt.Errorf("layer \"%s\" not found or not supported", e.Layer), int32(0))
+		}
+		parts[[2]string{e.Layer, path.Dir(e.Path)}] = true
 	}
-	for _, entry := range rm {
-		rmByLayer[entry.Layer] = append(rmByLayer[entry.Layer], entry)
-		layers[entry.Layer] = true
+	if len(parts) < 2 {
+		return J.apply(add, rm, "", false)
 	}
-	var promises []Promise[int32]
-	for l := range layers {
-		promises = append(promises, J.batchLayer(l, addByLayer[l], rmByLayer[l]))
+	commit, end, err := J.beginCommit(add, rm)
+	if err != nil {
+		return Fulfilled(err, int32(0))
 	}
-	return NewWaitForAll[int32](promises)
+	applied := J.apply(add, rm, commit, false)
+	res := NewPromise[int32]()
+	go func() {
+		_, err := applied.Get()
+		res.Done(0, end(err))
+	}()
+	return res
 }
 
-func (J *JSONIndex) batchLayer(layer string, add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
-	addByPath := make(map[string][]*IndexEntry)
-	rmByPath := make(map[string][]*IndexEntry)
-	paths := make(map[string]bool)
+// apply hands the entries to their partitions. Every partition is loaded
+// before any is changed, and kept loaded until all have the entries. commit
+// is the id of the commit record, marked in every partition. A replayed
+// record skips the partitions marked already and the files it already
+// removed. Runs under J.lock.
+func (J *JSONIndex) apply(add []*IndexEntry, rm []*IndexEntry, commit string, replay bool) Promise[int32] {
+	addByPart := make(map[[2]string][]*IndexEntry)
+	rmByPart := make(map[[2]string][]*IndexEntry)
 	for _, entry := range add {
-		_path := path.Dir(entry.Path)
-		addByPath[_path] = append(addByPath[_path], entry)
-		paths[_path] = true
+		key := [2]string{entry.Layer, path.Dir(entry.Path)}
+		addByPart[key] = append(addByPart[key], entry)
 	}
 	for _, entry := range rm {
-		_path := path.Dir(entry.Path)
-		rmByPath[_path] = append(rmByPath[_path], entry)
-		paths[_path] = true
+		key := [2]string{entry.Layer, path.Dir(entry.Path)}
+		rmByPart[key] = append(rmByPart[key], entry)
 	}
-
+	parts := make(map[string]map[string]*jsonPartIndex)
+	defer func() {
+		for _, layerParts := range parts {
+			for _, idx := range layerParts {
+				idx.pinned = false
+			}
+		}
+	}()
+	for _, entries := range [][]*IndexEntry{add, rm} {
+		for _, entry := range entries {
+			dir := path.Dir(entry.Path)
+			if parts[entry.Layer][dir] != nil {
+				continue
+			}
+			idx, err := J.populate(entry.Layer, dir)
+			if err != nil {
+				return Fulfilled[int32](err, 0)
+			}
+			idx.pinned = true
+			if parts[entry.Layer] == nil {
+				parts[entry.Layer] = make(map[string]*jsonPartIndex)
+			}
+			parts[entry.Layer][dir] = idx
+		}
+	}
+	var changed []*jsonPartIndex
+	for _, layerParts := range parts {
+		for _, idx := range layerParts {
+			changed = append(changed, idx)
+		}
+	}
+	J.change(changed...)
 	var promises []Promise[int32]
-	for partPath := range paths {
-		idx, err := J.populate(layer, partPath)
-		if err != nil {
-			return Fulfilled[int32](err, 0)
+	for layer, layerParts := range parts {
+		addByPath := make(map[string][]*IndexEntry)
+		rmByPath := make(map[string][]*IndexEntry)
+		targets := make(map[string]*jsonPartIndex)
+		for dir, idx := range layerParts {
+			key := [2]string{layer, dir}
+			addByPath[dir] = addByPart[key]
+			rmByPath[dir] = rmByPart[key]
+			if replay {
+				var err error
+				if rmByPath[dir], err = idx.unapplied(rmByPath[dir]); err != nil {
+					return Fulfilled[int32](err, 0)
+				}
+				if idx.committed(commit) {
+					// Later changes of the partition may override the record
+					continue
+				}
+			}
+			targets[dir] = idx
 		}
-		promises = append(promises, idx.Batch(addByPath[partPath], rmByPath[partPath]))
+		promises = append(promises, J.batchLayer(layer, targets, addByPath, rmByPath, commit))
 	}
 	return NewWaitForAll[int32](promises)
 }
 
+func (J *JSONIndex) batchLayer(layer string, parts map[string]*jsonPartIndex,
+	addByPath map[string][]*IndexEntry, rmByPath map[string][]*IndexEntry, commit string) Promise[int32] {
+	var promises []Promise[int32]
+	m := J.manifests[layer]
+	now := time.Now()
+	lowered := make(map[string]*jsonPlanDue)
+	for partPath, idx := range parts {
+		due := idx.batchDue(addByPath[partPath], rmByPath[partPath], now)
+		promises = append(promises, idx.batch(context.Background(), addByPath[partPath], rmByPath[partPath], commit))
+		m.m.Lock()
+		J.list(m, idx)
+		if m.lowersDue(partPath, due) {
+			lowered[partPath] = due
+		}
+		m.m.Unlock()
+	}
+	m.m.Lock()
+	dirty := m.dirty
+	m.m.Unlock()
+	if !dirty && len(lowered) == 0 {
+		return NewWaitForAll[int32](promises)
+	}
+	// The new partitions, and the work due earlier than the manifest says,
+	// are listed before the Batch resolves
+	res := NewPromise[int32]()
+	go func() {
+		_, err := NewWaitForAll[int32](promises).Get()
+		if err == nil {
+			// Once written: a partition summed up later holds the batch
+			stamp := time.Now().UnixNano()
+			m.m.Lock()
+			for dir, due := range lowered {
+				m.lowerDue(dir, due, stamp)
+			}
+			m.m.Unlock()
+			err = m.save(J.options.Durability != DurabilityNone)
+		}
+		res.Done(0, err)
+	}()
+	return res
+}
+
 func (J *JSONIndex) populate(layer string, dir string) (*jsonPartIndex, error) {
 	layerParts := J.parts[layer]
 	if layerParts == nil {
@@ -162,8 +525,14 @@ func (J *JSONIndex) populate(layer string, dir string) (*jsonPartIndex, error) {
 	}
 
 	if idx != nil {
+		J.lru.MoveToFront(idx.lruElem)
 		return idx, nil
 	}
+	if done := J.evicted[[2]string{layer, dir}]; done != nil {
+		// Its last changes are being written
+		<-done
+		delete(J.evicted, [2]string{layer, dir})
+	}
 	idx, err := newJsonPartIndex(jsonPartIdxOpts{
 		rootPath: _layer.Path,
 		database: J.database,
@@ -171,16 +540,26 @@ func (J *JSONIndex) populate(layer string, dir string) (*jsonPartIndex, error) {
 		partPath: dir,
 		layers:   J.layers,
 		layer:    layer,
+		options:  &J.options,
 	})
 	if err != nil {
 		return nil, err
 	}
 	idx.Run()
 	layerParts[dir] = idx
+	idx.lruElem = J.lru.PushFront(idx)
+	J.evict()
 	return idx, nil
 }
 
 func (J *JSONIndex) Get(layer string, _path string) *IndexEntry {
+	return J.GetCtx(context.Background(), layer, _path)
+}
+
+func (J *JSONIndex) GetCtx(ctx context.Context, layer string, _path string) *IndexEntry {
+	if ctx.Err() != nil {
+		return nil
+	}
 	dir := path.Dir(_path)
 	J.lock.Lock()
 	defer J.lock.Unlock()
@@ -188,99 +567,127 @@ func (J *JSONIndex) Get(layer string, _path string) *IndexEntry {
 	if err != nil {
 		return nil
 	}
-	return idx.Get(layer, _path)
+	return idx.GetCtx(ctx, layer, _path)
 }
 
+// Run starts the refresh of the partitions if IndexOptions.RefreshInterval
+// is set.
 func (J *JSONIndex) Run() {
-}
-
-func (J *JSONIndex) Stop() {
-	for _, l := range J.parts {
-		for _, idx := range l {
-			idx.Stop()
-		}
+	if J.options.RefreshInterval <= 0 || J.stop != nil {
+		return
 	}
+	var ctx context.Context
+	ctx, J.stop = context.WithCancel(context.Background())
+	J.done = make(chan struct{})
+	go func() {
+		defer close(J.done)
+		t := time.NewTicker(J.options.RefreshInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				J.refresh(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 }
 
-func (J *JSONIndex) findHours(options QueryOptions, layer jsonLayer) ([]time.Time, error) {
-	var hours []time.Time
-	err := filepath.Walk(path.Join(layer.Path, J.database, J.table, "data"), func(path string, info os.FileInfo, err error) error {
-		if info == nil {
-			return nil
+// refresh reloads the loaded partitions changed by other processes and, if
+// every partition is kept in memory, loads the new ones.
+func (J *JSONIndex) refresh(ctx context.Context) {
+	J.lock.Lock()
+	var parts []*jsonPartIndex
+	for e := J.lru.Front(); e != nil; e = e.Next() {
+		parts = append(parts, e.Value.(*jsonPartIndex))
+	}
+	J.lock.Unlock()
+	for _, p := range parts {
+		if ctx.Err() != nil {
+			return
 		}
-		if !info.IsDir() {
-			return nil
+		if err := p.refresh(); err != nil {
+			J.options.onError(fmt.Errorf("refreshing %s: %w", p.idxPath, err))
 		}
-		if strings.HasPrefix(info.Name(), "hour=") {
-			if options.Folder != "" && path != options.Folder {
-				return filepath.SkipDir
-			}
-			hour, err := strconv.Atoi(info.Name()[5:])
-			if err != nil {
-				return err
+	}
+	if J.options.boundedCache() {
+		// The partitions are read from the manifest when they are needed
+		return
+	}
+	for name, m := range J.manifests {
+		dirs, err := m.dirs(nil, nil)
+		if err != nil {
+			J.options.onError(fmt.Errorf("reading the manifest of %s: %w", name, err))
+			continue
+		}
+		J.lock.Lock()
+		for _, dir := range dirs {
+			if J.parts[name][dir] != nil {
+				continue
 			}
-			sep := string(filepath.Separator)
-			dirs := strings.Split(path, sep)
-			dateDir := dirs[len(dirs)-2]
-			date, err := time.Parse("2006-01-02", dateDir[5:])
-			if err != nil {
-				return err
+			if _, err := J.populate(name, dir); err != nil {
+				J.options.onError(fmt.Errorf("loading %s: %w", dir, err))
 			}
-			date = date.Add(time.Hour * time.Duration(hour))
-			hours = append(hours, date)
-			return filepath.SkipDir
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		J.lock.Unlock()
 	}
-	var _hours []time.Time
-	if options.Before.Unix() > 0 {
-		for i := len(hours) - 1; i >= 0; i-- {
-			if hours[i].Unix() < options.Before.Unix() {
-				_hours = append(_hours, hours[i])
-			}
+}
+
+func (J *JSONIndex) Stop() {
+	if J.stop != nil {
+		J.stop()
+		<-J.done
+	}
+	J.lock.Lock()
+	for _, done := range J.evicted {
+		<-done
+	}
+	clear(J.evicted)
+	J.lock.Unlock()
+	// The manifest gets the last counters and planner work of the partitions
+	for _, l := range J.parts {
+		for _, idx := range l {
+			J.sumUp(idx, J.manifests[idx.layer])
 		}
-		hours = _hours
 	}
-	if options.After.Unix() > 0 {
-		_after := time.Unix(options.After.Unix(), 0).Round(time.Hour)
-		for _, hour := range hours {
-			if hour.Unix() >= _after.Unix() {
-				_hours = append(_hours, hour)
-			}
+	for name, m := range J.manifests {
+		m.m.Lock()
+		changed := m.dirty || m.stale
+		m.m.Unlock()
+		if !changed {
+			continue
+		}
+		if err := m.save(J.options.Durability != DurabilityNone); err != nil {
+			J.options.onError(fmt.Errorf("saving the manifest of %s: %w", name, err))
 		}
-		hours = _hours
 	}
-
-	return hours, nil
 }
 
 func (J *JSONIndex) Query(options QueryOptions) ([]*IndexEntry, error) {
-	var entries []*IndexEntry
-	for _, l := range J.layers {
-		if l.Path == "" {
-			continue
-		}
-		hours, err := J.findHours(options, l)
-		if err != nil {
-			return nil, err
-		}
-		for _, hour := range hours {
-			idx, err := J.populate(l.Name, path.Join(
-				fmt.Sprintf("date=%s", hour.Format("2006-01-02")),
-				fmt.Sprintf("hour=%02d", hour.Hour())))
+	return J.QueryCtx(context.Background(), options)
+}
+
+func (J *JSONIndex) QueryCtx(ctx context.Context, options QueryOptions) ([]*IndexEntry, error) {
+	return collectEntries(J.QueryIter(ctx, options))
+}
+
+func (J *JSONIndex) QueryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return options.ordered(J.queryIter(ctx, options))
+}
+
+func (J *JSONIndex) queryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		for v, err := range J.snapshot(ctx, &options) {
 			if err != nil {
-				return nil, err
+				yield(nil, err)
+				return
 			}
-			_entries, err := idx.Query(options)
-			if err != nil {
-				return nil, err
+			for _, e := range v.entries {
+				if options.match(&e.IndexEntry) && !yield(&e.IndexEntry, nil) {
+					return
+				}
 			}
-			entries = append(entries, _entries...)
 		}
 	}
-
-	return entries, nil
 }
@@ -1,8 +1,16 @@
 package metadata
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"iter"
+	"os"
+	"path"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -92,3 +100,1151 @@ func TestJSONSaveAndRM(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestJSONQueryCancelled(t *testing.T) {
+	idx, err := NewJSONIndex(
+		"_testdata",
+		"default",
+		"test",
+		layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = idx.GetQuerier().QueryCtx(ctx, QueryOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestJSONMergeConfigurationPerLayer(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", []Layer{
+		{URL: "file://" + dir + "/hot", Name: "hot", Type: "fs"},
+		{URL: "file://" + dir + "/cold", Name: "cold", Type: "fs",
+			MergeConfigurations: []MergeConfigurationsConf{{0, 2500, 1}}},
+	}, IndexOptions{
+		MergeConfigurations: []MergeConfigurationsConf{{0, 10 * 1024 * 1024, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	var ents []*IndexEntry
+	for _, l := range []string{"hot", "cold"} {
+		for i := 0; i < 4; i++ {
+			ents = append(ents, &IndexEntry{
+				Layer:     l,
+				Database:  "default",
+				Table:     "test",
+				Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+				SizeBytes: 1000,
+				ChunkTime: time.Now().Add(-time.Minute).UnixNano(),
+			})
+		}
+	}
+	if _, err = idx.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	hot, err := idx.GetMergePlanner().GetMergePlan("", "hot", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hot.From) != 4 {
+		t.Fatalf("expected 4 files in the hot plan, got %d", len(hot.From))
+	}
+	cold, err := idx.GetMergePlanner().GetMergePlan("", "cold", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cold.From) != 2 {
+		t.Fatalf("expected 2 files in the cold plan, got %d", len(cold.From))
+	}
+}
+
+func TestJSONWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := jsonPartIdxOpts{
+		rootPath: dir,
+		database: "default",
+		table:    "test",
+		partPath: "date=2024-01-15/hour=14",
+		layers:   []jsonLayer{layer2JsonLayer(Layer{URL: "file://" + dir, Name: "l1", Type: "fs"})},
+		layer:    "l1",
+		options:  &IndexOptions{Durability: DurabilityWAL},
+	}
+	// Not running: nothing but the WAL reaches the disk, like after a crash
+	part, err := newJsonPartIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*IndexEntry
+	for i := 0; i < 3; i++ {
+		ents = append(ents, &IndexEntry{
+			Layer:     "l1",
+			Database:  "default",
+			Table:     "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+			SizeBytes: 1000,
+		})
+	}
+	if _, err = part.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Batch(nil, ents[:1]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	// A torn write of an unacknowledged batch
+	f, err := os.OpenFile(path.Join(part.idxPath, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"add":[{"pa`)
+	f.Close()
+
+	part, err = newJsonPartIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := part.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || part.Get("l1", ents[0].Path) != nil || part.parquetSizeBytes != 2000 {
+		t.Fatalf("expected the 2 remaining entries, got %d", len(all))
+	}
+	if len(part.dropQueue) != 1 || part.dropQueue[0].Path != ents[0].Path {
+		t.Fatalf("expected the removed entry in the drop queue, got %v", part.dropQueue)
+	}
+	// The next record replaces the torn one
+	if _, err = part.Batch(nil, ents[1:2]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	part, err = newJsonPartIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.walSeq != 3 || part.Get("l1", ents[1].Path) != nil {
+		t.Fatalf("expected the record appended after the torn one, got sequence %d", part.walSeq)
+	}
+	// The next replay starts after the records applied
+	if st, err := os.Stat(path.Join(part.idxPath, walFileName)); err != nil || part.walOffset != st.Size() {
+		t.Fatalf("expected the WAL offset at the end of the log, got %d %v", part.walOffset, err)
+	}
+
+	// The checkpoint empties the log
+	part.flush()
+	if st, err := os.Stat(path.Join(part.idxPath, walFileName)); err != nil || st.Size() != 0 {
+		t.Fatalf("expected an empty WAL after the flush, got %v %v", st, err)
+	}
+	if part.walOffset != 0 {
+		t.Fatalf("expected the WAL offset reset, got %d", part.walOffset)
+	}
+	part, err = newJsonPartIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.walSeq != 3 || part.Get("l1", ents[2].Path) == nil {
+		t.Fatalf("expected the checkpoint of the WAL sequence 3, got %d", part.walSeq)
+	}
+}
+
+func TestJSONPartitionEviction(t *testing.T) {
+	dir := t.TempDir()
+	_idx, err := NewJSONIndexWithOptions(dir, "default", "test", []Layer{
+		{URL: "file://" + dir, Name: "l1", Type: "fs"},
+	}, IndexOptions{
+		MergeConfigurations: []MergeConfigurationsConf{{0, 10 * 1024 * 1024, 1}},
+		MaxCachedPartitions: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := _idx.(*JSONIndex)
+	defer idx.Stop()
+	var ents []*IndexEntry
+	for h := 0; h < 4; h++ {
+		ents = append(ents, &IndexEntry{
+			Layer:     "l1",
+			Database:  "default",
+			Table:     "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=%02d/%s.1.parquet", h, uuid.New().String()),
+			SizeBytes: 1000,
+			ChunkTime: time.Now().Add(-time.Minute).UnixNano(),
+		})
+		if _, err = idx.Batch(ents[h:], nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded := func() int {
+		idx.lock.Lock()
+		defer idx.lock.Unlock()
+		return idx.lru.Len()
+	}
+	if loaded() != 2 {
+		t.Fatalf("expected 2 loaded partitions, got %d", loaded())
+	}
+	// The evicted partitions are read back from the disk
+	all, err := idx.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 || loaded() != 2 {
+		t.Fatalf("expected 4 entries and 2 loaded partitions, got %d and %d", len(all), loaded())
+	}
+
+	// The lease of a partition evicted during a merge is read back with it
+	plan, err := idx.GetMergePlanner().GetMergePlan("", "l1", 1)
+	if err != nil || len(plan.From) != 1 || path.Dir(plan.From[0]) != "date=2024-01-15/hour=00" {
+		t.Fatalf("expected a plan for hour=00, got %v %v", plan, err)
+	}
+	if _, err = idx.GetAll(); err != nil {
+		t.Fatal(err)
+	}
+	if idx.parts["l1"]["date=2024-01-15/hour=00"] != nil {
+		t.Fatalf("the partition merging was not evicted")
+	}
+	for {
+		again, err := idx.GetMergePlanner().GetMergePlan("", "l1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again.From) == 0 {
+			break
+		}
+		if slices.Contains(again.From, plan.From[0]) {
+			t.Fatalf("%s is planned twice", plan.From[0])
+		}
+	}
+	if _, err = idx.GetMergePlanner().EndMerge(plan).Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONTwoWriters(t *testing.T) {
+	dir := t.TempDir()
+	open := func() TableIndex {
+		// The drop plans are handed out right away
+		idx, err := NewJSONIndexWithOptions(dir, "default", "test", []Layer{
+			{URL: "file://" + dir, Name: "l1", Type: "fs"},
+		}, IndexOptions{DropDelay: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	newEntry := func() *IndexEntry {
+		return &IndexEntry{
+			Layer:     "l1",
+			Database:  "default",
+			Table:     "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+			SizeBytes: 1000,
+		}
+	}
+	// Both processes load the partition before the other one writes
+	a, b := open(), open()
+	a1, b1, b2 := newEntry(), newEntry(), newEntry()
+	if _, err := a.Batch([]*IndexEntry{a1}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Batch([]*IndexEntry{b1, b2}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Batch(nil, []*IndexEntry{a1}).Get(); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+	b.Stop()
+
+	c := open()
+	defer c.Stop()
+	all, err := c.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || c.Get("l1", b1.Path) == nil || c.Get("l1", b2.Path) == nil {
+		t.Fatalf("expected the entries of b, got %d entries", len(all))
+	}
+	stats, err := c.GetStats().Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Files != 2 || stats[0].SizeBytes != 2000 {
+		t.Fatalf("unexpected stats after the merge: %+v", stats[0].Stats)
+	}
+	drop, err := c.GetDropPlanner().GetDropQueue("", "l1")
+	if err != nil || drop.Path != a1.Path {
+		t.Fatalf("expected the drop of %s, got %v %v", a1.Path, drop, err)
+	}
+}
+
+func TestJSONRefresh(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	newEntry := func(hour int) *IndexEntry {
+		return &IndexEntry{
+			Layer:    "l1",
+			Database: "default",
+			Table:    "test",
+			Path:     fmt.Sprintf("date=2024-01-15/hour=%02d/%s.1.parquet", hour, uuid.New().String()),
+		}
+	}
+	writer, err := NewJSONIndex(dir, "default", "test", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Stop()
+	e1 := newEntry(14)
+	if _, err := writer.Batch([]*IndexEntry{e1}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewJSONIndexWithOptions(dir, "default", "test", layers,
+		IndexOptions{RefreshInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Run()
+	defer reader.Stop()
+
+	e2, e3 := newEntry(14), newEntry(15)
+	if _, err := writer.Batch([]*IndexEntry{e2, e3}, []*IndexEntry{e1}).Get(); err != nil {
+		t.Fatal(err)
+	}
+	var all []*IndexEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if all, err = reader.GetAll(); err != nil {
+			t.Fatal(err)
+		}
+		if len(all) == 2 && reader.Get("l1", e2.Path) != nil && reader.Get("l1", e3.Path) != nil {
+			return
+		}
+	}
+	t.Fatalf("the reader did not see the changes, got %d entries", len(all))
+}
+
+func TestJSONOnError(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	errs := make(chan error, 16)
+	options := IndexOptions{RefreshInterval: 10 * time.Millisecond, OnError: func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Run()
+	defer idx.Stop()
+	ent := &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+		Path: fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String())}
+	if _, err := idx.Batch([]*IndexEntry{ent}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	// Another process leaves a broken partition file
+	part := path.Join(dir, "default", "test", "data", path.Dir(ent.Path), "metadata.json")
+	if err := os.WriteFile(part+".bak", []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(part+".bak", part); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "refreshing") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the refresh error was not reported")
+	}
+}
+
+func TestJSONFormatMigration(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	partDir := path.Join(dir, "default", "test", "data", "date=2024-01-15", "hour=14")
+	if err := os.MkdirAll(partDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(data string) {
+		if err := os.WriteFile(path.Join(partDir, "metadata.json"), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A version 0 file: no version, stale totals, a field of another version
+	write(`{"type":"test","parquet_size_bytes":3000,"row_count":30,"min_time":0,"max_time":0,
+		"compression":"zstd","drop_queue":[{"ID":"","WriterID":"w1","Layer":"l1","Database":"default",
+			"Table":"test","Path":"date=2024-01-15/hour=14/old.1.parquet","TimeS":0}],"files":[
+		{"layer":"l1","database":"default","table":"test","path":"date=2024-01-15/hour=14/a.1.parquet",
+			"size_bytes":1000,"row_count":10,"min_time":100,"max_time":200,"id":1}]}`)
+
+	if _, err := NewJSONIndexWithOptions(dir, "default", "test", layers,
+		IndexOptions{StrictFormat: true}); err == nil || !strings.Contains(err.Error(), "compression") {
+		t.Fatalf("expected the unknown field to be reported, got %v", err)
+	}
+
+	idx, err := NewJSONIndex(dir, "default", "test", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := idx.GetStats().Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := stats[0].Stats
+	if s.SizeBytes != 1000 || s.RowCount != 10 || s.MinTime != 100 || s.MaxTime != 200 {
+		t.Fatalf("the totals were not migrated: %+v", s)
+	}
+	drop, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil || drop.ID == "" || drop.Path != "date=2024-01-15/hour=14/old.1.parquet" {
+		t.Fatalf("the drop queue was not migrated: %+v %v", drop, err)
+	}
+	e := &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+		Path: "date=2024-01-15/hour=14/b.1.parquet", SizeBytes: 1000, RowCount: 10, MinTime: 100, MaxTime: 200}
+	if _, err := idx.Batch([]*IndexEntry{e}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	data, err := os.ReadFile(path.Join(partDir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf(`"version":%d`, jsonFormatVersion)) {
+		t.Fatalf("the file was not upgraded: %s", data)
+	}
+
+	write(`{"type":"test","version":99,"files":[]}`)
+	if _, err := NewJSONIndex(dir, "default", "test", layers); err == nil {
+		t.Fatal("expected a newer version to be refused")
+	}
+}
+
+func TestJSONDeltaLog(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	partDir := path.Join(dir, "default", "test", "data", "date=2024-01-15", "hour=14")
+	open := func(checkpointBytes int64) TableIndex {
+		idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, IndexOptions{
+			CheckpointBytes: checkpointBytes,
+			DropDelay:       time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	var ents []*IndexEntry
+	for i := 0; i < 4; i++ {
+		ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path: fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()), SizeBytes: 1000})
+	}
+
+	idx := open(1 << 20)
+	for _, e := range ents {
+		if _, err := idx.Batch([]*IndexEntry{e}, nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := idx.Batch(nil, ents[:2]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	drop, err := idx.GetDropPlanner().GetDropQueue("", "l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.GetDropPlanner().RmFromDropQueue(drop).Get(); err != nil {
+		t.Fatal(err)
+	}
+	dropped := drop.Path
+	idx.Stop()
+	if _, err := os.Stat(path.Join(partDir, "metadata.json")); !os.IsNotExist(err) {
+		t.Fatalf("metadata.json was written before the checkpoint: %v", err)
+	}
+
+	// Every flush of the reopened index checkpoints the log
+	idx = open(1)
+	if all, _ := idx.GetAll(); len(all) != 2 {
+		t.Fatalf("expected 2 entries from the log, got %d", len(all))
+	}
+	drop, err = idx.GetDropPlanner().GetDropQueue("", "l1")
+	if err != nil || drop.Path == "" || drop.Path == dropped {
+		t.Fatalf("expected the other drop plan, got %v %v", drop, err)
+	}
+	if _, err := idx.Batch(nil, ents[2:3]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	if size, err := os.Stat(path.Join(partDir, walFileName)); err != nil || size.Size() != 0 {
+		t.Fatalf("the log was not checkpointed: %v", err)
+	}
+
+	idx = open(0)
+	defer idx.Stop()
+	if all, _ := idx.GetAll(); len(all) != 1 || all[0].Path != ents[3].Path {
+		t.Fatalf("unexpected entries after the checkpoint: %v", all)
+	}
+	stats, err := idx.GetStats().Stats()
+	if err != nil || stats[0].Files != 1 || stats[0].SizeBytes != 1000 {
+		t.Fatalf("unexpected stats after the checkpoint: %v %v", stats, err)
+	}
+}
+
+func TestJSONCodecs(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		codec Codec
+		magic []byte
+	}{
+		{"json", CodecJSON, []byte("{")},
+		{"gzip", CodecGzip, gzipMagic},
+		{"binary", CodecBinary, binaryMagic},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+			file := path.Join(dir, "default", "test", "data", "date=2024-01-15", "hour=14", "metadata.json")
+			idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, IndexOptions{Codec: c.codec})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ents []*IndexEntry
+			for i := 0; i < 3; i++ {
+				ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+					Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+					SizeBytes: 1000, RowCount: 10, MinTime: int64(i), MaxTime: int64(i + 1), WriterID: "w1",
+					Min: map[string]any{"value": float64(i)}, Max: map[string]any{"value": "z"}})
+			}
+			if _, err := idx.Batch(ents, nil).Get(); err != nil {
+				t.Fatal(err)
+			}
+			idx.Stop()
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), string(c.magic)) {
+				t.Fatalf("unexpected encoding %q", data[:min(len(data), 8)])
+			}
+
+			// The codec is detected, whatever the codec of the index
+			idx, err = NewJSONIndex(dir, "default", "test", layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idx.Stop()
+			for _, e := range ents {
+				got := idx.Get("l1", e.Path)
+				if got == nil || got.SizeBytes != e.SizeBytes || got.MaxTime != e.MaxTime || got.WriterID != "w1" ||
+					got.Min["value"] != e.Min["value"] || got.Max["value"] != "z" {
+					t.Fatalf("unexpected entry %+v", got)
+				}
+			}
+			stats, err := idx.GetStats().Stats()
+			if err != nil || stats[0].Files != 3 || stats[0].SizeBytes != 3000 || stats[0].MaxTime != 3 {
+				t.Fatalf("unexpected stats %v %v", stats, err)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	partDir := path.Join(dir, "default", "test", "data", "date=2024-01-15", "hour=14")
+	if err := os.MkdirAll(partDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	truncated := append(append(slices.Clone(binaryMagic), 2, '{', '}'), 10, 1)
+	if err := os.WriteFile(path.Join(partDir, "metadata.json"), truncated, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJSONIndex(dir, "default", "test", []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}); err == nil {
+		t.Fatal("expected a truncated binary file to fail")
+	}
+}
+
+func TestJSONMoveLeases(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{
+		{URL: "file://" + path.Join(dir, "l1"), Name: "l1", Type: "fs", TTLSec: 1},
+		{URL: "file://" + path.Join(dir, "l2"), Name: "l2", Type: "fs"},
+	}
+	options := IndexOptions{MergeConfigurations: []MergeConfigurationsConf{{0, 2500, 1}}}
+	open := func() TableIndex {
+		idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	idx := open()
+	ent := &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+		Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.2.parquet", uuid.New().String()),
+		SizeBytes: 1000, RowCount: 10, ChunkTime: time.Now().Add(-time.Hour).UnixNano(), WriterID: "w1"}
+	if _, err := idx.Batch([]*IndexEntry{ent}, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil || plan.PathFrom != ent.Path || plan.ID == "" {
+		t.Fatalf("unexpected move plan %+v %v", plan, err)
+	}
+	idx.Stop()
+
+	// The lease survives a restart
+	idx = open()
+	if again, err := idx.GetMovePlanner().GetMovePlan("w1", "l1"); err != nil || again.PathFrom != "" {
+		t.Fatalf("%s is planned twice: %v", again.PathFrom, err)
+	}
+	if _, err := idx.GetMovePlanner().EndMove(plan).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+
+	// An expired lease is handed out again, with the same plan
+	options.LeaseTimeout = time.Millisecond
+	idx = open()
+	defer idx.Stop()
+	plan, err = idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil || plan.PathFrom != ent.Path {
+		t.Fatalf("unexpected move plan %+v %v", plan, err)
+	}
+	again, err := idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil || again.ID != plan.ID || again.PathTo != plan.PathTo {
+		t.Fatalf("expired lease %+v not handed out again: %+v %v", plan, again, err)
+	}
+}
+
+func TestJSONMergeLeases(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	options := IndexOptions{MergeConfigurations: []MergeConfigurationsConf{{0, 2500, 1}}}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*IndexEntry
+	for i := 0; i < 2; i++ {
+		ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+			SizeBytes: 1000, RowCount: 10, WriterID: "w1"})
+	}
+	if _, err := idx.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := idx.GetMergePlanner().GetMergePlan("w1", "l1", 1)
+	if err != nil || len(plan.From) != 2 {
+		t.Fatalf("unexpected merge plan %+v %v", plan, err)
+	}
+	idx.Stop()
+
+	// A restarted compactor does not get the files of the running merge
+	idx, err = NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	if again, err := idx.GetMergePlanner().GetMergePlan("w1", "l1", 1); err != nil || len(again.From) != 0 {
+		t.Fatalf("%v are planned twice: %v", again.From, err)
+	}
+	if _, err := idx.GetMergePlanner().EndMerge(plan).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := idx.GetMergePlanner().GetMergePlan("w1", "l1", 1); err != nil || len(again.From) != 2 {
+		t.Fatalf("files of the ended merge not planned again: %+v %v", again, err)
+	}
+}
+
+func TestJSONDropLeases(t *testing.T) {
+	for _, d := range []Durability{DurabilityNone, DurabilityWAL} {
+		dir := t.TempDir()
+		layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+		options := IndexOptions{DropDelay: time.Millisecond, Durability: d}
+		idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ent := &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path: fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()), WriterID: "w1"}
+		if _, err := idx.Batch([]*IndexEntry{ent}, nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idx.Batch(nil, []*IndexEntry{ent}).Get(); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+		if err != nil || plan.Path != ent.Path {
+			t.Fatalf("unexpected drop plan %+v %v", plan, err)
+		}
+		wal := path.Join(dir, "default", "test", "data", path.Dir(ent.Path), walFileName)
+		if _, err := os.Stat(wal); d == DurabilityNone && !os.IsNotExist(err) {
+			t.Fatalf("the lease is logged without durability: %v", err)
+		}
+		idx.Stop()
+
+		// The lease survives a restart
+		idx, err = NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, err := idx.GetDropPlanner().GetDropQueue("w1", "l1"); err != nil || again.Path != "" {
+			t.Fatalf("%s is handed out twice: %v", again.Path, err)
+		}
+
+		// The file indexed and removed again has a plan of its own
+		if _, err := idx.Batch([]*IndexEntry{ent}, nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := idx.Batch(nil, []*IndexEntry{ent}).Get(); err != nil {
+			t.Fatal(err)
+		}
+		next, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+		if err != nil || next.Path != ent.Path || next.ID == plan.ID {
+			t.Fatalf("unexpected drop plan %+v %v", next, err)
+		}
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := idx.GetDropPlanner().RmFromDropQueueCtx(cancelled, next).Get(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the cancellation, got %v", err)
+		}
+		if _, err := idx.GetDropPlanner().RmFromDropQueue(next).Get(); err != nil {
+			t.Fatal(err)
+		}
+		idx.Stop()
+		idx, err = NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := idx.(*JSONIndex).populate("l1", path.Dir(ent.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(part.dropQueue) != 1 || part.dropQueue[0].ID != plan.ID {
+			t.Fatalf("unexpected drop queue %+v", part.dropQueue)
+		}
+		idx.Stop()
+	}
+}
+
+func TestJSONManifest(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	open := func(options IndexOptions) TableIndex {
+		idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+	hour := func(h int) time.Time {
+		return time.Date(2024, 1, 15, h, 0, 0, 0, time.UTC)
+	}
+	// b is a reader started before a writes
+	a, b := open(IndexOptions{MaxCachedPartitions: 1}), open(IndexOptions{})
+	defer b.Stop()
+	var ents []*IndexEntry
+	for _, h := range []int{14, 15} {
+		ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=%d/%s.1.parquet", h, uuid.New().String()),
+			SizeBytes: 1000, MinTime: hour(h).UnixNano(), MaxTime: hour(h).Add(time.Minute).UnixNano()})
+	}
+	if _, err := a.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+
+	data, err := os.ReadFile(path.Join(dir, "default", "test", "data", manifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file jsonManifestFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	p := file.Partitions["date=2024-01-15/hour=14"]
+	if len(file.Partitions) != 2 || p == nil || p.Files != 1 || p.SizeBytes != 1000 ||
+		p.MinTime != hour(14).UnixNano() || p.MaxTime != hour(15).UnixNano()-1 {
+		t.Fatalf("unexpected manifest %s", data)
+	}
+	res, err := b.GetQuerier().Query(QueryOptions{After: hour(15), Before: hour(16)})
+	if err != nil || len(res) != 1 || res[0].Path != ents[1].Path {
+		t.Fatalf("unexpected query result %v %v", res, err)
+	}
+
+	// A missing manifest is rebuilt
+	if err := os.Remove(path.Join(dir, "default", "test", "data", manifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+	c := open(IndexOptions{MaxCachedPartitions: 1})
+	defer c.Stop()
+	if res, err := c.GetQuerier().Query(QueryOptions{}); err != nil || len(res) != 2 {
+		t.Fatalf("unexpected query result %v %v", res, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "default", "test", "data", manifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONManifestPrune(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	options := IndexOptions{MaxCachedPartitions: 1, DropDelay: time.Millisecond}
+	data := path.Join(dir, "default", "test", "data")
+	readManifest := func() jsonManifestFile {
+		raw, err := os.ReadFile(path.Join(data, manifestFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file jsonManifestFile
+		if err := json.Unmarshal(raw, &file); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*IndexEntry
+	for _, h := range []int{14, 15} {
+		ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test", WriterID: "w1",
+			Path: fmt.Sprintf("date=2024-01-15/hour=%d/%s.1.parquet", h, uuid.New().String()), SizeBytes: 1000})
+	}
+	if _, err := idx.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	// Emptied: the file and its drop plan are gone
+	if _, err := idx.Batch(nil, ents[:1]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil || plan.Path != ents[0].Path {
+		t.Fatalf("unexpected drop plan %+v %v", plan, err)
+	}
+	if _, err := idx.GetDropPlanner().RmFromDropQueue(plan).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	if file := readManifest(); len(file.Partitions) != 1 || file.Partitions[path.Dir(ents[1].Path)] == nil {
+		t.Fatalf("expected the emptied partition pruned, got %v", file.Partitions)
+	}
+
+	// Removed from the disk: read, it is pruned and not created again
+	gone := path.Join(data, path.Dir(ents[1].Path))
+	if err := os.RemoveAll(gone); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := idx.GetQuerier().Query(QueryOptions{}); err != nil || len(res) != 0 {
+		t.Fatalf("unexpected query result %v %v", res, err)
+	}
+	idx.Stop()
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Fatalf("the read created %s: %v", gone, err)
+	}
+	if file := readManifest(); len(file.Partitions) != 0 {
+		t.Fatalf("expected the removed partition pruned, got %v", file.Partitions)
+	}
+}
+
+func TestJSONSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := NewJSONIndex(dir, "default", "test", []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	newEntry := func(h int) *IndexEntry {
+		return &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=%d/%s.1.parquet", h, uuid.New().String()),
+			SizeBytes: 1000}
+	}
+	cur := []*IndexEntry{newEntry(14), newEntry(15)}
+	if _, err := idx.Batch(cur, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	// Every Batch replaces the two files by two files of the other partitions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			next := []*IndexEntry{newEntry(14 + (i+1)%2), newEntry(16)}
+			if _, err := idx.Batch(next, cur).Get(); err != nil {
+				t.Error(err)
+				return
+			}
+			cur = next
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		all, err := idx.GetAll()
+		if err != nil || len(all) != 2 {
+			t.Fatalf("expected 2 files, got %d %v", len(all), err)
+		}
+		stats, err := idx.GetStats().Stats()
+		if err != nil || stats[0].Files != 2 || stats[0].SizeBytes != 2000 {
+			t.Fatalf("unexpected stats %+v %v", stats[0].Stats, err)
+		}
+	}
+	// A reader open across a Batch reads the partitions as they were
+	next, stop := iter.Pull2(idx.GetAllIter(context.Background()))
+	files := 0
+	if _, err, ok := next(); !ok || err != nil {
+		t.Fatalf("expected a file, got %v", err)
+	}
+	files++
+	if _, err := idx.Batch([]*IndexEntry{newEntry(14), newEntry(15)}, cur).Get(); err != nil {
+		t.Fatal(err)
+	}
+	for _, err, ok := next(); ok; _, err, ok = next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		files++
+	}
+	stop()
+	if files != 2 {
+		t.Fatalf("expected 2 files, got %d", files)
+	}
+	if kept := len(idx.(*JSONIndex).keeping); kept != 0 {
+		t.Fatalf("%d partitions still keep views", kept)
+	}
+}
+
+func TestJSONCommitRecovery(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	commits := path.Join(dir, "default", "test", commitDirName)
+	newEntries := func() []*IndexEntry {
+		var res []*IndexEntry
+		for _, h := range []int{14, 15} {
+			res = append(res, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+				Path:      fmt.Sprintf("date=2024-01-15/hour=%d/%s.1.parquet", h, uuid.New().String()),
+				SizeBytes: 1000})
+		}
+		return res
+	}
+	idx, err := NewJSONIndex(dir, "default", "test", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := newEntries()
+	if _, err := idx.Batch(slices.Concat(first, newEntries()), nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Batch(nil, first).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := os.ReadDir(commits); err != nil || len(files) != 0 {
+		t.Fatalf("the commit record was not removed: %v %v", files, err)
+	}
+	idx.Stop()
+
+	// A crash after the record was written, and one while it was written.
+	// The files the record removes are gone already.
+	ents := newEntries()
+	data, err := json.Marshal(jsonCommitRecord{Add: ents, Rm: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(commits, "crashed.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(commits, "torn.tmp"), data[:10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = NewJSONIndex(dir, "default", "test", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	for _, e := range ents {
+		if idx.Get("l1", e.Path) == nil {
+			t.Fatalf("%s was not recovered", e.Path)
+		}
+	}
+	if all, err := idx.GetAll(); err != nil || len(all) != 4 {
+		t.Fatalf("expected 4 files, got %d %v", len(all), err)
+	}
+	if files, err := os.ReadDir(commits); err != nil || len(files) != 0 {
+		t.Fatalf("the commit records were not removed: %v %v", files, err)
+	}
+	drops := 0
+	for _, e := range first {
+		part, err := idx.(*JSONIndex).populate("l1", path.Dir(e.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drops += len(part.dropQueue)
+	}
+	if drops != len(first) {
+		t.Fatalf("expected %d drop plans, got %d", len(first), drops)
+	}
+}
+
+func TestJSONCommitFailure(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	commits := path.Join(dir, "default", "test", commitDirName)
+	newEntry := func(h int) *IndexEntry {
+		return &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=%d/%s.1.parquet", h, uuid.New().String()),
+			SizeBytes: 1000}
+	}
+	// The flushes of hour 15 fail until the directory is removed
+	blocker := path.Join(dir, "default", "test", "data", "date=2024-01-15", "hour=15", "metadata.json.bak")
+	if err := os.MkdirAll(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, IndexOptions{OnError: func(error) {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := newEntry(14), newEntry(15)
+	if _, err := idx.Batch([]*IndexEntry{x, y}, nil).Get(); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+	if _, err := idx.Batch(nil, []*IndexEntry{x}).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record of the failed batch is not applied again to hour 14
+	idx, err = NewJSONIndex(dir, "default", "test", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	if idx.Get("l1", x.Path) != nil {
+		t.Fatalf("%s came back", x.Path)
+	}
+	if idx.Get("l1", y.Path) == nil {
+		t.Fatalf("%s was not recovered", y.Path)
+	}
+	if files, err := os.ReadDir(commits); err != nil || len(files) != 0 {
+		t.Fatalf("the commit record was not removed: %v %v", files, err)
+	}
+}
+
+func TestJSONCommitMerge(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	options := IndexOptions{MergeConfigurations: []MergeConfigurationsConf{{0, 2500, 1}}, DropDelay: time.Millisecond}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*IndexEntry
+	for i := 0; i < 2; i++ {
+		ents = append(ents, &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=14/%s.1.parquet", uuid.New().String()),
+			SizeBytes: 1000, RowCount: 10, WriterID: "w1"})
+	}
+	if _, err := idx.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := idx.GetMergePlanner().GetMergePlan("w1", "l1", 1)
+	if err != nil || len(plan.From) != 2 {
+		t.Fatalf("unexpected merge plan %+v %v", plan, err)
+	}
+	result := &IndexEntry{Layer: "l1", Database: "default", Table: "test", Path: plan.To,
+		SizeBytes: 2000, RowCount: 20, WriterID: "w1"}
+	if _, err := idx.GetMergePlanner().CommitMerge(plan, result).Get(); err != nil {
+		t.Fatal(err)
+	}
+	idx.Stop()
+
+	// The commit is one log record: all of it is there after a restart
+	idx, err = NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+	all, err := idx.GetAll()
+	if err != nil || len(all) != 1 || all[0].Path != plan.To {
+		t.Fatalf("unexpected entries after the commit: %v %v", all, err)
+	}
+	for range ents {
+		drop, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+		if err != nil || !slices.Contains(plan.From, drop.Path) {
+			t.Fatalf("unexpected drop plan %+v %v", drop, err)
+		}
+	}
+	if _, err := idx.GetMergePlanner().CommitMerge(plan, result).Get(); err == nil {
+		t.Fatal("a plan is committed twice")
+	}
+}
+
+func TestJSONPlannerManifest(t *testing.T) {
+	dir := t.TempDir()
+	layers := []Layer{{URL: "file://" + dir, Name: "l1", Type: "fs"}}
+	options := IndexOptions{
+		MergeConfigurations: []MergeConfigurationsConf{{10, 10 * 1024 * 1024, 1}},
+		MaxCachedPartitions: 1,
+	}
+	idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 3; h++ {
+		chunkTime := time.Now()
+		if h == 0 {
+			chunkTime = chunkTime.Add(-time.Hour)
+		}
+		e := &IndexEntry{Layer: "l1", Database: "default", Table: "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=%02d/%s.1.parquet", h, uuid.New().String()),
+			SizeBytes: 1000, ChunkTime: chunkTime.UnixNano(), WriterID: "w1"}
+		if _, err = idx.Batch([]*IndexEntry{e}, nil).Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Stop()
+
+	_idx, err := NewJSONIndexWithOptions(dir, "default", "test", layers, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx = _idx
+	defer idx.Stop()
+	loaded := func() []string {
+		J := idx.(*JSONIndex)
+		J.lock.Lock()
+		defer J.lock.Unlock()
+		var res []string
+		for dir := range J.parts["l1"] {
+			res = append(res, dir)
+		}
+		return res
+	}
+	// Only the partition the manifest has a merge due for is read
+	plan, err := idx.GetMergePlanner().GetMergePlan("w1", "l1", 1)
+	if err != nil || len(plan.From) != 1 || path.Dir(plan.From[0]) != "date=2024-01-15/hour=00" {
+		t.Fatalf("expected a plan for hour=00, got %v %v", plan, err)
+	}
+	if dirs := loaded(); len(dirs) != 1 || dirs[0] != "date=2024-01-15/hour=00" {
+		t.Fatalf("expected hour=00 alone loaded, got %v", dirs)
+	}
+	for _, w := range []string{"w1", "w2"} {
+		if move, err := idx.GetMovePlanner().GetMovePlan(w, "l1"); err != nil || move.PathFrom != "" {
+			t.Fatalf("unexpected move plan %+v %v", move, err)
+		}
+		if drop, err := idx.GetDropPlanner().GetDropQueue(w, "l1"); err != nil || drop.Path != "" {
+			t.Fatalf("unexpected drop plan %+v %v", drop, err)
+		}
+	}
+	if dirs := loaded(); len(dirs) != 1 {
+		t.Fatalf("the planners read %v", dirs)
+	}
+}
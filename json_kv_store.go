@@ -84,6 +84,13 @@ func (j *jsonKVStoreIndex) Destroy() {
 }
 
 func (j *jsonKVStoreIndex) Get(key string) ([]byte, error) {
+	return j.GetCtx(context.Background(), key)
+}
+
+func (j *jsonKVStoreIndex) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	j.m.Lock()
 	defer j.m.Unlock()
 
@@ -94,24 +101,38 @@ func (j *jsonKVStoreIndex) Get(key string) ([]byte, error) {
 }
 
 func (j *jsonKVStoreIndex) Put(key string, value []byte) error {
+	return j.PutCtx(context.Background(), key, value)
+}
+
+func (j *jsonKVStoreIndex) PutCtx(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	j.m.Lock()
 	j.cache[key] = value
 	p := NewPromise[int32]()
 	j.savePromises = append(j.savePromises, p)
 	j.planSave()
 	j.m.Unlock()
-	_, err := p.Get()
+	_, err := Await(ctx, p)
 	return err
 }
 
 func (j *jsonKVStoreIndex) Delete(key string) error {
+	return j.DeleteCtx(context.Background(), key)
+}
+
+func (j *jsonKVStoreIndex) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	j.m.Lock()
 	delete(j.cache, key)
 	p := NewPromise[int32]()
 	j.savePromises = append(j.savePromises, p)
 	j.planSave()
 	j.m.Unlock()
-	_, err := p.Get()
+	_, err := Await(ctx, p)
 	return err
 }
 
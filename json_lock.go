@@ -0,0 +1,42 @@
+package metadata
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+const lockFileName = "metadata.lock"
+
+// partLock serializes the writers of a partition: the goroutines of this
+// process through the mutex, the other processes through an advisory lock on
+// metadata.lock. It is taken before jsonPartIndex.m.
+type partLock struct {
+	m    sync.Mutex
+	path string
+}
+
+func (l *partLock) lock() (func(), error) {
+	l.m.Lock()
+	f, err := os.OpenFile(path.Join(l.path, lockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if os.IsNotExist(err) {
+		// The first writer of a partition creates its directory
+		if err = os.MkdirAll(l.path, 0o755); err == nil {
+			f, err = os.OpenFile(path.Join(l.path, lockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+		}
+	}
+	if err != nil {
+		l.m.Unlock()
+		return nil, err
+	}
+	if err = flock(f); err != nil {
+		f.Close()
+		l.m.Unlock()
+		return nil, err
+	}
+	return func() {
+		funlock(f)
+		f.Close()
+		l.m.Unlock()
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package metadata
+
+import "os"
+
+// Advisory locks are not supported: only one process may open a JSON root.
+
+func flock(f *os.File) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,291 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	manifestFileName    = "manifest.json"
+	jsonManifestVersion = 1
+)
+
+// jsonManifestPart are the totals of a partition in the manifest. The time
+// bounds cover the files and the time bucket of the partition: they only grow
+// when a file lands outside of its bucket, so the manifest is seldom
+// rewritten. The counters are those of the last rewrite.
+type jsonManifestPart struct {
+	MinTime   int64 `json:"min_time"`
+	MaxTime   int64 `json:"max_time"`
+	Files     int64 `json:"files"`
+	SizeBytes int64 `json:"size_bytes"`
+	RowCount  int64 `json:"row_count"`
+	// Due sums up the work of the planners, nil until the partition is
+	// summed up
+	Due *jsonPlanDue `json:"due"`
+}
+
+// jsonManifest lists the partitions of a layer of the table, kept in
+// data/manifest.json. Queries find their partitions in it instead of walking
+// the layer. A Batch adding a partition, or widening its time bounds, rewrites
+// it before it resolves. A missing manifest is rebuilt from the partition
+// directories.
+type jsonManifest struct {
+	m     sync.Mutex
+	dir   string
+	flock partLock
+	parts map[string]*jsonManifestPart
+	// dirty is set when parts has partitions or bounds manifest.json misses,
+	// stale when only its counters are behind
+	dirty bool
+	stale bool
+	// dropped are the partitions removed since the last save, sync does not
+	// bring them back
+	dropped map[string]bool
+	// manifest.json as last read or written by this process
+	diskInfo os.FileInfo
+}
+
+type jsonManifestFile struct {
+	Version    int                          `json:"version"`
+	Partitions map[string]*jsonManifestPart `json:"partitions"`
+}
+
+func newJsonManifest(dir string) *jsonManifest {
+	return &jsonManifest{
+		dir:     dir,
+		flock:   partLock{path: dir},
+		parts:   make(map[string]*jsonManifestPart),
+		dropped: make(map[string]bool),
+	}
+}
+
+// set records the totals of a partition. Runs under m.m.
+func (m *jsonManifest) set(dir string, s *PartitionStats, scheme PartitionScheme) {
+	var lo, hi int64
+	bounded := s.Files > 0
+	if bounded {
+		lo, hi = s.MinTime, s.MaxTime
+	}
+	if start, _, err := scheme.Parse(dir); err == nil {
+		end := start.Add(scheme.Span()).UnixNano() - 1
+		if bounded {
+			lo, hi = min(lo, start.UnixNano()), max(hi, end)
+		} else {
+			lo, hi, bounded = start.UnixNano(), end, true
+		}
+	}
+	delete(m.dropped, dir)
+	p := m.parts[dir]
+	if p == nil {
+		p = &jsonManifestPart{MinTime: lo, MaxTime: hi}
+		m.parts[dir] = p
+		m.dirty = true
+	} else if bounded && (lo < p.MinTime || hi > p.MaxTime) {
+		p.MinTime, p.MaxTime = min(p.MinTime, lo), max(p.MaxTime, hi)
+		m.dirty = true
+	}
+	if p.Files != s.Files || p.SizeBytes != s.SizeBytes || p.RowCount != s.RowCount {
+		p.Files, p.SizeBytes, p.RowCount = s.Files, s.SizeBytes, s.RowCount
+		m.stale = true
+	}
+}
+
+// drop removes a partition. Runs under m.m.
+func (m *jsonManifest) drop(dir string) {
+	if m.parts[dir] == nil {
+		return
+	}
+	delete(m.parts, dir)
+	m.dropped[dir] = true
+	m.dirty = true
+}
+
+// lowersDue tells if the times of a batch are earlier than the summary of
+// the partition, so that the manifest has to be saved. Runs under m.m.
+func (m *jsonManifest) lowersDue(dir string, d *jsonPlanDue) bool {
+	p := m.parts[dir]
+	return p != nil && p.Due != nil && p.Due.clone().lower(d)
+}
+
+// lowerDue brings the times of a batch written at stamp in. The partitions
+// not summed up yet are planned anyway. Runs under m.m.
+func (m *jsonManifest) lowerDue(dir string, d *jsonPlanDue, stamp int64) {
+	p := m.parts[dir]
+	if p == nil || p.Due == nil {
+		return
+	}
+	if p.Due.lower(d) {
+		m.dirty = true
+	}
+	p.Due.Lowered = max(p.Due.Lowered, stamp)
+}
+
+// sumDue brings in a summary computed from the partition. Runs under m.m.
+func (m *jsonManifest) sumDue(dir string, d *jsonPlanDue) {
+	p := m.parts[dir]
+	if p == nil {
+		return
+	}
+	if p.Due != nil && p.Due.clone().lower(d) {
+		m.dirty = true
+	} else {
+		m.stale = true
+	}
+	p.Due = p.Due.merge(d)
+}
+
+// dueDirs returns the sorted partitions where the planners of the writer may
+// find work by now: the ones past the time picked by due and the ones not
+// summed up yet.
+func (m *jsonManifest) dueDirs(writerId string, due func(w *jsonWriterDue) int64, now int64) ([]string, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err := m.sync(); err != nil {
+		return nil, err
+	}
+	var res []string
+	for dir, p := range m.parts {
+		if p.Due != nil {
+			w := p.Due.Writers[writerId]
+			if w == nil {
+				continue
+			}
+			if s := due(w); s == 0 || s > now {
+				continue
+			}
+		}
+		res = append(res, dir)
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// sync reads manifest.json if another process replaced it. The bounds of
+// the known partitions are widened, the new ones added. Runs under m.m.
+func (m *jsonManifest) sync() error {
+	st, err := os.Stat(path.Join(m.dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if m.diskInfo != nil && sameDiskFile(st, m.diskInfo) {
+		return nil
+	}
+	data, err := os.ReadFile(path.Join(m.dir, manifestFileName))
+	if err != nil {
+		return err
+	}
+	var file jsonManifestFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", path.Join(m.dir, manifestFileName), err)
+	}
+	if file.Version > jsonManifestVersion {
+		return fmt.Errorf("%s: format version %d is newer than %d, upgrade gigapi",
+			path.Join(m.dir, manifestFileName), file.Version, jsonManifestVersion)
+	}
+	for dir, p := range file.Partitions {
+		if m.dropped[dir] {
+			continue
+		}
+		if cur := m.parts[dir]; cur != nil {
+			cur.MinTime, cur.MaxTime = min(cur.MinTime, p.MinTime), max(cur.MaxTime, p.MaxTime)
+			cur.Due = cur.Due.merge(p.Due)
+			continue
+		}
+		m.parts[dir] = p
+	}
+	m.diskInfo = st
+	return nil
+}
+
+// save merges the manifest of the other processes and rewrites
+// manifest.json.
+func (m *jsonManifest) save(durable bool) error {
+	unlock, err := m.flock.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err = m.sync(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(jsonManifestFile{Version: jsonManifestVersion, Partitions: m.parts})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path.Join(m.dir, manifestFileName+".bak"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if durable {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(path.Join(m.dir, manifestFileName+".bak"), path.Join(m.dir, manifestFileName)); err != nil {
+		return err
+	}
+	if durable {
+		if err = syncDir(m.dir); err != nil {
+			return err
+		}
+	}
+	if m.diskInfo, err = os.Stat(path.Join(m.dir, manifestFileName)); err != nil {
+		return err
+	}
+	m.dirty = false
+	m.stale = false
+	clear(m.dropped)
+	return nil
+}
+
+// dirs returns the sorted partitions of the query, all of them if options
+// is nil.
+func (m *jsonManifest) dirs(options *QueryOptions, scheme PartitionScheme) ([]string, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err := m.sync(); err != nil {
+		return nil, err
+	}
+	var res []string
+	for dir, p := range m.parts {
+		if options != nil && !options.matchManifest(scheme, dir, p) {
+			continue
+		}
+		res = append(res, dir)
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// matchManifest tells if the partition may hold files of the query.
+func (o *QueryOptions) matchManifest(scheme PartitionScheme, dir string, p *jsonManifestPart) bool {
+	folder := strings.Trim(o.Folder, "/")
+	if folder != "" && !strings.HasPrefix(dir+"/", folder) && !strings.HasPrefix(folder, dir+"/") {
+		return false
+	}
+	if len(o.Keys) > 0 {
+		_, keys, err := scheme.Parse(dir)
+		if err != nil || !o.matchKeys(keys) {
+			return false
+		}
+	}
+	if o.Before.Unix() > 0 && p.MinTime > o.Before.UnixNano() {
+		return false
+	}
+	return o.After.Unix() <= 0 || p.MaxTime >= o.After.UnixNano()
+}
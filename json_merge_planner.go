@@ -1,16 +1,29 @@
 package metadata
 
-import "path"
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
 
 func (J *JSONIndex) GetMergePlan(writerId string, layer string, iteration int) (MergePlan, error) {
+	return J.GetMergePlanCtx(context.Background(), writerId, layer, iteration)
+}
+
+func (J *JSONIndex) GetMergePlanCtx(ctx context.Context, writerId string, layer string, iteration int) (MergePlan, error) {
 	J.lock.Lock()
 	defer J.lock.Unlock()
-	parts, ok := J.parts[layer]
-	if !ok {
-		return MergePlan{}, nil
+	dirs, err := J.plannedDirs(layer, writerId, func(w *jsonWriterDue) int64 { return w.Merge[iteration] })
+	if err != nil {
+		return MergePlan{}, err
 	}
-	for _, part := range parts {
-		plan, err := part.GetMergePlan(writerId, layer, iteration)
+	for _, dir := range dirs {
+		part, err := J.populate(layer, dir)
+		if err != nil {
+			return MergePlan{}, err
+		}
+		plan, err := part.GetMergePlanCtx(ctx, writerId, layer, iteration)
 		if err != nil {
 			return MergePlan{}, err
 		}
@@ -23,18 +36,78 @@ func (J *JSONIndex) GetMergePlan(writerId string, layer string, iteration int) (
 }
 
 func (J *JSONIndex) EndMerge(plan MergePlan) Promise[int32] {
+	return J.EndMergeCtx(context.Background(), plan)
+}
+
+func (J *JSONIndex) EndMergeCtx(ctx context.Context, plan MergePlan) Promise[int32] {
 	if len(plan.From) == 0 {
-		return nil
+		return Fulfilled[int32](nil, 0)
 	}
 	J.lock.Lock()
 	defer J.lock.Unlock()
-	parts := J.parts[plan.Layer]
 	dir := path.Dir(plan.From[0])
-	part := parts[dir]
+	part := J.parts[plan.Layer][dir]
+	if part == nil && J.options.boundedCache() {
+		var err error
+		if part, err = J.populate(plan.Layer, dir); err != nil {
+			return Fulfilled(err, int32(0))
+		}
+	}
 	if part != nil {
-		return part.EndMerge(plan)
+		return part.EndMergeCtx(ctx, plan)
+	}
+	return Fulfilled[int32](nil, 0)
+}
+
+func (J *JSONIndex) CommitMerge(plan MergePlan, result *IndexEntry) Promise[int32] {
+	return J.CommitMergeCtx(context.Background(), plan, result)
+}
+
+// CommitMergeCtx replaces the merged files with the result in their partition.
+// The result has to be written to the same partition.
+func (J *JSONIndex) CommitMergeCtx(ctx context.Context, plan MergePlan, result *IndexEntry) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	// The plan is found by its id in the partition of the result, the merged
+	// files are the ones it was handed out with
+	dir := path.Dir(result.Path)
+	if result.Layer != plan.Layer {
+		return Fulfilled[int32](fmt.Errorf("merge result %s is not in the layer \"%s\"", result.Path, plan.Layer), 0)
 	}
-	return nil
+	J.lock.Lock()
+	defer J.lock.Unlock()
+	m := J.manifests[plan.Layer]
+	if m == nil {
+		return Fulfilled(fmt.Errorf("layer \"%s\" not found or not supported", plan.Layer), int32(0))
+	}
+	part, err := J.populate(plan.Layer, dir)
+	if err != nil {
+		return Fulfilled(err, int32(0))
+	}
+	// The drop plans of the merged files are due with the ones of the writer
+	due := part.batchDue([]*IndexEntry{result}, []*IndexEntry{{WriterID: plan.WriterID}}, time.Now())
+	J.change(part)
+	committed := part.CommitMergeCtx(ctx, plan, result)
+	m.m.Lock()
+	J.list(m, part)
+	m.m.Unlock()
+	// Like a Batch, the flush is waited for without the locks
+	res := NewPromise[int32]()
+	go func() {
+		_, err := committed.Get()
+		if err == nil {
+			m.m.Lock()
+			m.lowerDue(dir, due, time.Now().UnixNano())
+			dirty := m.dirty
+			m.m.Unlock()
+			if dirty {
+				err = m.save(J.options.Durability != DurabilityNone)
+			}
+		}
+		res.Done(0, err)
+	}()
+	return res
 }
 
 func (J *JSONIndex) GetMergePlanner() TableMergePlanner {
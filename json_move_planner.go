@@ -1,19 +1,27 @@
 package metadata
 
 import (
-	"fmt"
+	"context"
 	"path"
 )
 
 func (J *JSONIndex) GetMovePlan(writerId string, layer string) (MovePlan, error) {
+	return J.GetMovePlanCtx(context.Background(), writerId, layer)
+}
+
+func (J *JSONIndex) GetMovePlanCtx(ctx context.Context, writerId string, layer string) (MovePlan, error) {
 	J.lock.Lock()
 	defer J.lock.Unlock()
-	l := J.parts[layer]
-	if l == nil {
-		return MovePlan{}, nil
+	dirs, err := J.plannedDirs(layer, writerId, func(w *jsonWriterDue) int64 { return w.Move })
+	if err != nil {
+		return MovePlan{}, err
 	}
-	for _, p := range l {
-		mp, err := p.GetMovePlanner().GetMovePlan(writerId, layer)
+	for _, dir := range dirs {
+		p, err := J.populate(layer, dir)
+		if err != nil {
+			return MovePlan{}, err
+		}
+		mp, err := p.GetMovePlanCtx(ctx, writerId, layer)
 		if err != nil {
 			return MovePlan{}, err
 		}
@@ -25,18 +33,27 @@ func (J *JSONIndex) GetMovePlan(writerId string, layer string) (MovePlan, error)
 }
 
 func (J *JSONIndex) EndMove(plan MovePlan) Promise[int32] {
+	return J.EndMoveCtx(context.Background(), plan)
+}
+
+func (J *JSONIndex) EndMoveCtx(ctx context.Context, plan MovePlan) Promise[int32] {
+	if plan.PathFrom == "" {
+		return Fulfilled[int32](nil, 0)
+	}
 	J.lock.Lock()
 	defer J.lock.Unlock()
-	l := J.parts[plan.LayerFrom]
-	if l == nil {
-		return Fulfilled(fmt.Errorf("layer \"%s\" not found", plan.LayerFrom), int32(0))
-	}
 	dir := path.Dir(plan.PathFrom)
-	part := l[dir]
+	part := J.parts[plan.LayerFrom][dir]
+	if part == nil && J.options.boundedCache() {
+		var err error
+		if part, err = J.populate(plan.LayerFrom, dir); err != nil {
+			return Fulfilled(err, int32(0))
+		}
+	}
 	if part != nil {
-		return part.EndMove(plan)
+		return part.EndMoveCtx(ctx, plan)
 	}
-	return nil
+	return Fulfilled[int32](nil, 0)
 }
 
 func (J *JSONIndex) GetMovePlanner() TableMovePlanner {
@@ -1,38 +1,98 @@
 package metadata
 
+import (
+	"context"
+	"slices"
+	"time"
+)
+
 func (J *jsonPartIndex) GetDropPlanner() TableDropPlanner {
 	return J
 }
 
 func (J *jsonPartIndex) RmFromDropQueue(plan DropPlan) Promise[int32] {
+	return J.RmFromDropQueueCtx(context.Background(), plan)
+}
+
+// RmFromDropQueueCtx logs the removal of the plan like the other changes of
+// the planners. Under DurabilityNone it resolves once flushed.
+func (J *jsonPartIndex) RmFromDropQueueCtx(ctx context.Context, plan DropPlan) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	found := false
+	err := J.logged(func(rec *jsonWalRecord) {
+		// A file removed, indexed and removed again has several plans
+		if slices.ContainsFunc(J.dropQueue, func(d DropPlan) bool { return d.ID == plan.ID }) {
+			found = true
+			rec.Dropped = append(rec.Dropped, plan.ID)
+		}
+	})
+	if err != nil || !found {
+		return Fulfilled(err, int32(0))
+	}
 	J.m.Lock()
 	defer J.m.Unlock()
+	if J.options.Durability == DurabilityNone {
+		p := NewPromise[int32]()
+		J.promises = append(J.promises, p)
+		J.doUpdate()
+		return p
+	}
+	J.doUpdate()
+	return Fulfilled(nil, int32(0))
+}
 
-	updated := false
+func (J *jsonPartIndex) GetDropQueue(writerId string, layer string) (DropPlan, error) {
+	return J.GetDropQueueCtx(context.Background(), writerId, layer)
+}
 
-	for i := len(J.dropQueue) - 1; i >= 0; i-- {
-		if J.dropQueue[i].Path != plan.Path {
-			continue
+// GetDropQueueCtx hands out the oldest plan of the writer whose TimeS is
+// past: the drop delay of a new plan, the lease of a handed out one. The plan
+// is leased, its new TimeS logged, before it is returned.
+func (J *jsonPartIndex) GetDropQueueCtx(ctx context.Context, writerId string, layer string) (DropPlan, error) {
+	if err := ctx.Err(); err != nil {
+		return DropPlan{}, err
+	}
+	now := time.Now()
+	J.m.Lock()
+	plan := J.nextDrop(writerId, layer, now)
+	J.m.Unlock()
+	if plan == nil {
+		return DropPlan{}, nil
+	}
+	err := J.logged(func(rec *jsonWalRecord) {
+		// Another process may have taken it in the meantime
+		if plan = J.nextDrop(writerId, layer, now); plan != nil {
+			rec.DropLeases = append(rec.DropLeases, *plan)
 		}
-		J.dropQueue[i] = J.dropQueue[len(J.dropQueue)-1]
-		J.dropQueue = J.dropQueue[:len(J.dropQueue)-1]
-		updated = true
-		break
+	})
+	if err != nil || plan == nil {
+		return DropPlan{}, err
 	}
+	return *plan, nil
+}
 
-	if !updated {
-		return Fulfilled[int32](nil, 0)
+// nextDrop returns the next plan of the writer with its leased TimeS, without
+// taking it. Runs under J.m.
+func (J *jsonPartIndex) nextDrop(writerId string, layer string, now time.Time) *DropPlan {
+	for _, d := range J.dropQueue {
+		if d.WriterID != writerId || d.Layer != layer || int64(d.TimeS) > now.Unix() {
+			continue
+		}
+		d.TimeS = int32(now.Unix() + J.options.leaseTimeoutSec())
+		return &d
 	}
-
-	p := NewPromise[int32]()
-	J.promises = append(J.promises, p)
-	J.doUpdate()
-	return p
+	return nil
 }
 
-func (J *jsonPartIndex) GetDropQueue(writerId string, layer string) (DropPlan, error) {
-	if len(J.dropQueue) == 0 {
-		return DropPlan{}, nil
+// leaseDrop sets the TimeS of a queued plan. Runs under J.m.
+func (J *jsonPartIndex) leaseDrop(plan DropPlan) {
+	for _, q := range [][]DropPlan{J.dropQueue, J.pending.drops} {
+		for i := range q {
+			if q[i].ID == plan.ID {
+				q[i].TimeS = plan.TimeS
+			}
+		}
 	}
-	return J.dropQueue[0], nil
 }
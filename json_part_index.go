@@ -1,13 +1,18 @@
 package metadata
 
 import (
+	"bufio"
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/google/uuid"
 	jsoniter "github.com/json-iterator/go"
+	"iter"
+	"maps"
 	"os"
 	"path"
-	"strings"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +33,7 @@ type jsonPartIdxOpts struct {
 	partPath string
 	layers   []jsonLayer
 	layer    string
+	options  *IndexOptions
 }
 
 type jsonPartIndex struct {
@@ -36,8 +42,10 @@ type jsonPartIndex struct {
 	table    string
 	layer    string
 	layers   []jsonLayer
+	options  *IndexOptions
 
-	idxPath string
+	partPath string
+	idxPath  string
 
 	entries   *sync.Map
 	promises  []Promise[int32]
@@ -46,6 +54,7 @@ type jsonPartIndex struct {
 	doUpdate  context.CancelFunc
 	workCtx   context.Context
 	stop      context.CancelFunc
+	done      chan struct{}
 	lastId    uint32
 
 	dropQueue        []DropPlan
@@ -53,8 +62,35 @@ type jsonPartIndex struct {
 	rowCount         int64
 	minTime          int64
 	maxTime          int64
-	filesInMerge     map[string]bool
-	filesInMove      map[string]bool
+	iterations       map[int]IterationStats
+	walSeq           uint64
+	// walOffset is the end of the last record of the log applied
+	walOffset int64
+	// metadata.json as last read or written by this process
+	diskInfo os.FileInfo
+	pending  *jsonPartPending
+	flock    partLock
+	// memBytes is the size of the serialized entries and of the views
+	memBytes atomic.Int64
+	lruElem  *list.Element
+	// pinned keeps the partition loaded while a Batch spanning several
+	// partitions is applied, under JSONIndex.lock
+	pinned bool
+	// merge and move leases by id and the files they hold
+	merges       map[string]*jsonMergeLease
+	filesInMerge map[string]string
+	moves        map[string]*jsonMoveLease
+	filesInMove  map[string]string
+	// view is the snapshot of the entries read by the queries, nil after a
+	// change until the next query
+	view *jsonPartView
+	// changed is the last change of the table that kept a view, old are the
+	// views kept for the readers started before their change. Changed under
+	// JSONIndex.lock and J.m.
+	changed uint64
+	old     []*jsonPartView
+	// commits are the ids of the commit records applied to the partition
+	commits map[string]bool
 }
 
 var _ TableIndex = &jsonPartIndex{}
@@ -64,28 +100,50 @@ func newJsonPartIndex(opts jsonPartIdxOpts) (*jsonPartIndex, error) {
 		rootPath:     opts.rootPath,
 		database:     opts.database,
 		table:        opts.table,
+		partPath:     opts.partPath,
 		idxPath:      path.Join(opts.rootPath, opts.database, opts.table, "data", opts.partPath),
 		entries:      &sync.Map{},
-		filesInMerge: make(map[string]bool),
+		iterations:   make(map[int]IterationStats),
+		pending:      newJsonPartPending(),
+		flock:        partLock{path: path.Join(opts.rootPath, opts.database, opts.table, "data", opts.partPath)},
+		merges:       make(map[string]*jsonMergeLease),
+		filesInMerge: make(map[string]string),
+		moves:        make(map[string]*jsonMoveLease),
+		filesInMove:  make(map[string]string),
+		commits:      make(map[string]bool),
+		layer:        opts.layer,
 		layers:       opts.layers,
+		options:      opts.options,
 	}
-	_, err := os.Stat(res.idxPath)
-	if os.IsNotExist(err) {
-		os.MkdirAll(res.idxPath, 0o755)
+	if res.options == nil {
+		res.options = &IndexOptions{}
 	}
 	res.updateCtx, res.doUpdate = context.WithCancel(context.Background())
 	res.workCtx, res.stop = context.WithCancel(context.Background())
-	err = res.populate()
+	err := res.populate()
 	return res, err
 }
 
 func (J *jsonPartIndex) GetAll() ([]*IndexEntry, error) {
-	var res []*IndexEntry
-	J.entries.Range(func(key, value interface{}) bool {
-		res = append(res, J.jEntry2Entry(value.(*jsonIndexEntry)))
-		return true
-	})
-	return res, nil
+	return J.GetAllCtx(context.Background())
+}
+
+func (J *jsonPartIndex) GetAllCtx(ctx context.Context) ([]*IndexEntry, error) {
+	return collectEntries(J.GetAllIter(ctx))
+}
+
+func (J *jsonPartIndex) GetAllIter(ctx context.Context) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+			return
+		}
+		for _, e := range J.snapshot().entries {
+			if !yield(J.jEntry2Entry(e), nil) {
+				return
+			}
+		}
+	}
 }
 
 func (J *jsonPartIndex) getLayer(name string) int {
@@ -97,51 +155,136 @@ func (J *jsonPartIndex) getLayer(name string) int {
 	return -1
 }
 
+func (J *jsonPartIndex) mergeConfigurations() []MergeConfigurationsConf {
+	if idx := J.getLayer(J.layer); idx >= 0 {
+		return J.options.mergeConfigurations(&J.layers[idx].Layer)
+	}
+	return J.options.mergeConfigurations(nil)
+}
+
 func (J *jsonPartIndex) GetQuerier() TableQuerier {
 	return J
 }
 
-func (J *jsonPartIndex) Query(options QueryOptions) ([]*IndexEntry, error) {
-	var res []*IndexEntry
-	var suffix string
-	if options.Iteration != 0 {
-		suffix = fmt.Sprintf(".%d.parquet", options.Iteration)
+func (J *jsonPartIndex) GetStats() TableStats {
+	return J
+}
+
+func (J *jsonPartIndex) Stats() ([]*LayerStats, error) {
+	return J.StatsCtx(context.Background())
+}
+
+func (J *jsonPartIndex) StatsCtx(ctx context.Context) ([]*LayerStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	J.entries.Range(func(key, value interface{}) bool {
-		_v := value.(*jsonIndexEntry)
-		if suffix != "" && !strings.HasSuffix(_v.Path, suffix) {
-			return true
-		}
-		if options.Before.Unix() > 0 && _v.MinTime > options.Before.UnixNano() {
-			return true
+	var layers []string
+	for _, l := range J.layers {
+		layers = append(layers, l.Name)
+	}
+	return layerStats(layers, []*PartitionStats{J.snapshot().stats}), nil
+}
+
+// partitionStats reads the counters of the partition.
+// idle tells if the partition has no file and no work for the planners.
+func (J *jsonPartIndex) idle() bool {
+	J.m.Lock()
+	defer J.m.Unlock()
+	return len(J.iterations) == 0 && len(J.dropQueue) == 0 && len(J.merges) == 0 && len(J.moves) == 0
+}
+
+func (J *jsonPartIndex) partitionStats() *PartitionStats {
+	J.m.Lock()
+	defer J.m.Unlock()
+	return J.statsLocked()
+}
+
+// statsLocked reads the counters of the partition. Runs under J.m.
+func (J *jsonPartIndex) statsLocked() *PartitionStats {
+	res := &PartitionStats{
+		Layer: J.layer,
+		Path:  J.partPath,
+		Stats: Stats{
+			SizeBytes:  J.parquetSizeBytes,
+			RowCount:   J.rowCount,
+			MinTime:    J.minTime,
+			MaxTime:    J.maxTime,
+			Iterations: maps.Clone(J.iterations),
+		},
+	}
+	for _, it := range J.iterations {
+		res.Files += it.Files
+	}
+	return res
+}
+
+func (J *jsonPartIndex) Query(options QueryOptions) ([]*IndexEntry, error) {
+	return J.QueryCtx(context.Background(), options)
+}
+
+func (J *jsonPartIndex) QueryCtx(ctx context.Context, options QueryOptions) ([]*IndexEntry, error) {
+	return collectEntries(J.QueryIter(ctx, options))
+}
+
+func (J *jsonPartIndex) QueryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return options.ordered(J.queryIter(ctx, options))
+}
+
+func (J *jsonPartIndex) queryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		if err := ctx.Err(); err != nil {
+			yield(nil, err)
+			return
 		}
-		if options.After.Unix() > 0 && _v.MaxTime < options.After.UnixNano() {
-			return true
+		for _, _e := range J.snapshot().entries {
+			e := J.jEntry2Entry(_e)
+			if options.match(e) && !yield(e, nil) {
+				return
+			}
 		}
-		res = append(res, J.jEntry2Entry(_v))
-		return true
-	})
-	return res, nil
+	}
 }
 
-func (J *jsonPartIndex) addToDropQueue(files []*IndexEntry) {
+func (J *jsonPartIndex) newDropPlans(files []*IndexEntry) []DropPlan {
+	now := time.Now()
+	var res []DropPlan
 	for _, f := range files {
-		J.dropQueue = append(J.dropQueue, DropPlan{
+		res = append(res, DropPlan{
+			ID:       uuid.New().String(),
 			WriterID: f.WriterID,
 			Layer:    f.Layer,
 			Database: f.Database,
 			Table:    f.Table,
 			Path:     f.Path,
-			TimeS:    int32(time.Now().Add(time.Second * 30).Unix()),
+			TimeS:    int32(now.Unix() + J.options.dropDelaySec()),
 		})
 	}
+	return res
+}
 
+// unapplied are the files of rm still indexed and not queued for dropping:
+// the ones a replayed Batch has not removed yet.
+func (J *jsonPartIndex) unapplied(rm []*IndexEntry) ([]*IndexEntry, error) {
+	// Other processes may have changed the partition since it was loaded
+	if err := J.refresh(); err != nil {
+		return nil, err
+	}
+	J.m.Lock()
+	defer J.m.Unlock()
+	var res []*IndexEntry
+	for _, e := range rm {
+		_, ok := J.entries.Load(e.Path)
+		if ok && !slices.ContainsFunc(J.dropQueue, func(d DropPlan) bool { return d.Path == e.Path }) {
+			res = append(res, e)
+		}
+	}
+	return res, nil
 }
 
 func (J *jsonPartIndex) populate() error {
 	partPath := J.idxPath
 	if _, err := os.Stat(path.Join(partPath, "metadata.json")); os.IsNotExist(err) {
-		return nil
+		return J.replayWAL()
 	}
 
 	f, err := os.Open(path.Join(partPath, "metadata.json"))
@@ -149,93 +292,117 @@ func (J *jsonPartIndex) populate() error {
 		return err
 	}
 	defer f.Close()
+	if J.diskInfo, err = f.Stat(); err != nil {
+		return err
+	}
 
-	iter := jsoniter.Parse(jsoniter.ConfigDefault, f, 4096)
-	iter.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
-		switch s {
-		case "drop_queue":
-			for iterator.ReadArray() {
-				var dropQueueEntry DropPlan
-				iterator.ReadMapCB(func(iterator *jsoniter.Iterator, s string) bool {
-					switch s {
-					case "writer_id":
-						dropQueueEntry.WriterID = iterator.ReadString()
-					case "layer":
-						dropQueueEntry.Layer = iterator.ReadString()
-					case "database":
-						dropQueueEntry.Database = iterator.ReadString()
-					case "table":
-						dropQueueEntry.Table = iterator.ReadString()
-					case "path":
-						dropQueueEntry.Path = iterator.ReadString()
-					case "time_s":
-						dropQueueEntry.TimeS = iterator.ReadInt32()
-					default:
-						iterator.Skip()
-					}
-					return true
-				})
-				J.dropQueue = append(J.dropQueue, dropQueueEntry)
-			}
-		case "type":
-			iterator.Skip()
-		case "parquet_size_bytes":
-			J.parquetSizeBytes = iterator.ReadInt64()
-		case "row_count":
-			J.rowCount = iterator.ReadInt64()
-		case "min_time":
-			J.minTime = iterator.ReadInt64()
-		case "max_time":
-			J.maxTime = iterator.ReadInt64()
-		case "wal_sequence":
-			iterator.Skip()
-		case "files":
-			err = J.populateFiles(iterator)
-			if err != nil {
-				return false
-			}
-		}
-		return true
-	})
+	version, err := J.decode(bufio.NewReader(f))
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %w", path.Join(partPath, "metadata.json"), err)
 	}
-	if iter.Error != nil {
-		return iter.Error
+	if err = J.migrate(version); err != nil {
+		return err
 	}
-	return nil
+	return J.replayWAL()
 }
 
 func (J *jsonPartIndex) populateFiles(iter *jsoniter.Iterator) error {
 	for iter.ReadArray() {
 		e := &jsonIndexEntry{}
 		iter.ReadVal(e)
-		_marshalled, err := json.Marshal(e)
-		if err != nil {
+		if err := J.loadEntry(e); err != nil {
 			return err
 		}
-		e._marshalled = string(_marshalled)
-		if e.Id > J.lastId {
-			J.lastId = e.Id
-		}
-		J.entries.Store(e.Path, e)
 	}
 	return nil
 }
 
+// loadEntry adds an entry read from metadata.json, the totals come from the
+// header of the file.
+func (J *jsonPartIndex) loadEntry(e *jsonIndexEntry) error {
+	_marshalled, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	e._marshalled = string(_marshalled)
+	if e.Id > J.lastId {
+		J.lastId = e.Id
+	}
+	J.entries.Store(e.Path, e)
+	J.countIteration(&e.IndexEntry, 1)
+	J.memBytes.Add(int64(len(e._marshalled)))
+	return nil
+}
+
 func (J *jsonPartIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return J.BatchCtx(context.Background(), add, rm)
+}
+
+func (J *jsonPartIndex) BatchCtx(ctx context.Context, add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return J.batch(ctx, add, rm, "")
+}
+
+// batch applies a Batch. commit is the id of the record of a Batch spanning
+// several partitions, "" for the others: the partition keeps it as a mark,
+// the record is not applied again on recovery.
+func (J *jsonPartIndex) batch(ctx context.Context, add []*IndexEntry, rm []*IndexEntry, commit string) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
 	_add, err := J.entry2JEntry(add)
 	if err != nil {
 		return Fulfilled[int32](err, 0)
 	}
+	if J.options.Durability == DurabilityWAL {
+		unlock, err := J.flock.lock()
+		if err != nil {
+			return Fulfilled[int32](err, 0)
+		}
+		defer unlock()
+	}
 	J.m.Lock()
 	defer J.m.Unlock()
-	J.add(_add)
-	removed := J.rm(rm)
-	if len(_add) == 0 && !removed {
+	if J.options.Durability == DurabilityWAL {
+		// The log is shared with the other processes
+		if err := J.syncFromDisk(); err != nil {
+			return Fulfilled[int32](err, 0)
+		}
+	}
+	removed := slices.ContainsFunc(rm, func(e *IndexEntry) bool {
+		_, ok := J.entries.Load(e.Path)
+		return ok
+	})
+	if len(_add) == 0 && !removed && commit == "" {
 		return Fulfilled(nil, int32(0))
 	}
-	J.addToDropQueue(rm)
+	drops := J.newDropPlans(rm)
+	var logErr error
+	if J.options.Durability == DurabilityWAL {
+		var commits []string
+		if commit != "" {
+			commits = []string{commit}
+		}
+		// The other partitions of a commit have it: it is applied anyway
+		// and written by the next flush
+		if logErr = J.appendWAL(_add, rm, drops, nil, commits); logErr != nil && commit == "" {
+			return Fulfilled[int32](logErr, 0)
+		}
+	}
+	J.add(_add)
+	J.rm(rm)
+	J.dropQueue = append(J.dropQueue, drops...)
+	J.pending.batch(_add, rm, drops)
+	if commit != "" {
+		J.commits[commit] = true
+		if J.options.Durability != DurabilityWAL || logErr != nil {
+			J.pending.commits[commit] = true
+		}
+	}
+	if J.options.Durability == DurabilityWAL {
+		// The batch is durable in the log, metadata.json can catch up later
+		J.doUpdate()
+		return Fulfilled(logErr, int32(0))
+	}
 	p := NewPromise[int32]()
 	J.promises = append(J.promises, p)
 	J.doUpdate()
@@ -262,12 +429,39 @@ func (J *jsonPartIndex) entry2JEntry(entries []*IndexEntry) ([]*jsonIndexEntry,
 	return res, nil
 }
 
+// countIteration adds (sign 1) or subtracts (sign -1) the entry from the
+// iteration totals.
+func (J *jsonPartIndex) countIteration(e *IndexEntry, sign int64) {
+	i := pathIteration(e.Path)
+	it := J.iterations[i]
+	it.Files += sign
+	it.SizeBytes += sign * e.SizeBytes
+	it.RowCount += sign * e.RowCount
+	if it.Files == 0 {
+		delete(J.iterations, i)
+		return
+	}
+	J.iterations[i] = it
+}
+
 func (J *jsonPartIndex) add(entries []*jsonIndexEntry) {
+	J.dropView()
 	for _, entry := range entries {
+		if e, ok := J.entries.Load(entry.Path); ok {
+			// The entry is replaced, its counters go away
+			_e := e.(*jsonIndexEntry)
+			J.rowCount -= _e.RowCount
+			J.parquetSizeBytes -= _e.SizeBytes
+			J.countIteration(&_e.IndexEntry, -1)
+			J.memBytes.Add(-int64(len(_e._marshalled)))
+		}
+		empty := len(J.iterations) == 0
+		J.countIteration(&entry.IndexEntry, 1)
+		J.memBytes.Add(int64(len(entry._marshalled)))
 		J.rowCount += entry.RowCount
 		J.parquetSizeBytes += entry.SizeBytes
 		J.entries.Store(entry.Path, entry)
-		if entry.Id == 1 {
+		if empty {
 			J.minTime = entry.MinTime
 			J.maxTime = entry.MaxTime
 			continue
@@ -316,6 +510,7 @@ func (J *jsonPartIndex) recalcMax() {
 }
 
 func (J *jsonPartIndex) rm(path []*IndexEntry) bool {
+	J.dropView()
 	rm := false
 	for _, entry := range path {
 		e, ok := J.entries.Load(entry.Path)
@@ -326,6 +521,8 @@ func (J *jsonPartIndex) rm(path []*IndexEntry) bool {
 		rm = true
 		J.rowCount -= _e.RowCount
 		J.parquetSizeBytes -= _e.SizeBytes
+		J.countIteration(&_e.IndexEntry, -1)
+		J.memBytes.Add(-int64(len(_e._marshalled)))
 		J.entries.Delete(entry.Path)
 		if _e.MinTime == J.minTime {
 			J.recalcMin()
@@ -337,28 +534,83 @@ func (J *jsonPartIndex) rm(path []*IndexEntry) bool {
 	return rm
 }
 
+// flush merges the partition with the version of the other processes and
+// rewrites metadata.json under the partition lock. In delta mode the changes
+// are appended to the log instead until it outgrows CheckpointBytes.
 func (J *jsonPartIndex) flush() {
+	unlock, lockErr := J.flock.lock()
+	if lockErr == nil {
+		defer unlock()
+	}
 	J.m.Lock()
 	J.updateCtx, J.doUpdate = context.WithCancel(context.Background())
-	var entries []string
-	dropQueue := J.dropQueue
-	parquetSizeBytes := J.parquetSizeBytes
 	promises := J.promises
 	J.promises = nil
-	rowCount := J.rowCount
-	minTime := J.minTime
-	maxTime := J.maxTime
-	J.entries.Range(func(key, value any) bool {
-		entries = append(entries, value.(*jsonIndexEntry)._marshalled)
-		return true
-	})
-	J.m.Unlock()
-
+	if lockErr == nil {
+		lockErr = J.syncFromDisk()
+	}
+	if lockErr != nil {
+		J.m.Unlock()
+		if len(promises) == 0 {
+			J.options.onError(fmt.Errorf("syncing %s: %w", J.idxPath, lockErr))
+		}
+		for _, p := range promises {
+			p.Done(0, lockErr)
+		}
+		return
+	}
+	pending := J.pending
+	J.pending = newJsonPartPending()
 	onErr := func(err error) {
+		if err != nil {
+			// The next flush merges these changes again
+			J.m.Lock()
+			pending.merge(J.pending)
+			J.pending = pending
+			J.m.Unlock()
+		}
+		if err != nil && len(promises) == 0 {
+			// Nobody waits for the WAL mode flushes
+			J.options.onError(fmt.Errorf("flushing %s: %w", J.idxPath, err))
+		}
 		for _, p := range promises {
 			p.Done(0, err)
 		}
 	}
+	// A commit the log missed is only written by a checkpoint
+	unlogged := J.options.Durability == DurabilityWAL && len(pending.commits) > 0
+	if J.options.CheckpointBytes > 0 && !unlogged {
+		checkpoint, err := J.appendDelta(pending)
+		if err != nil || !checkpoint {
+			J.m.Unlock()
+			onErr(err)
+			return
+		}
+	}
+	snap := &jsonPartSnapshot{
+		dropQueue:        J.dropQueue,
+		parquetSizeBytes: J.parquetSizeBytes,
+		rowCount:         J.rowCount,
+		minTime:          J.minTime,
+		maxTime:          J.maxTime,
+		walSeq:           J.walSeq,
+		merges:           make([]jsonMergeLease, 0, len(J.merges)),
+		moves:            make([]jsonMoveLease, 0, len(J.moves)),
+	}
+	for _, l := range J.merges {
+		snap.merges = append(snap.merges, *l)
+	}
+	for _, l := range J.moves {
+		snap.moves = append(snap.moves, *l)
+	}
+	J.pruneCommits()
+	snap.commits = slices.Sorted(maps.Keys(J.commits))
+	walSeq := J.walSeq
+	J.entries.Range(func(key, value any) bool {
+		snap.entries = append(snap.entries, value.(*jsonIndexEntry))
+		return true
+	})
+	J.m.Unlock()
 
 	f, err := os.Create(path.Join(J.idxPath, "metadata.json.bak"))
 	if err != nil {
@@ -367,103 +619,91 @@ func (J *jsonPartIndex) flush() {
 	}
 	defer f.Close()
 
-	stream := jsoniter.NewStream(jsoniter.ConfigDefault, f, 4096)
-
-	// Start encoding the JSON structure
-	stream.WriteObjectStart()
-
-	stream.WriteObjectField("type")
-	stream.WriteString(J.table)
-
-	stream.WriteMore()
-	stream.WriteObjectField("parquet_size_bytes")
-	stream.WriteInt64(parquetSizeBytes)
-
-	stream.WriteMore()
-	stream.WriteObjectField("row_count")
-	stream.WriteInt64(rowCount)
-
-	stream.WriteMore()
-	stream.WriteObjectField("min_time")
-	stream.WriteInt64(minTime)
-
-	stream.WriteMore()
-	stream.WriteObjectField("max_time")
-	stream.WriteInt64(maxTime)
-
-	stream.WriteMore()
-	stream.WriteObjectField("wal_sequence")
-	stream.WriteInt64(0)
-
-	stream.WriteMore()
-	stream.WriteObjectField("drop_queue")
-	stream.WriteArrayStart()
-	for i, d := range dropQueue {
-		if i > 0 {
-			stream.WriteMore()
-		}
-		strD, err := json.Marshal(d)
-		if err != nil {
+	if err = J.encode(f, snap); err != nil {
+		onErr(err)
+		return
+	}
+	if J.options.Durability != DurabilityNone {
+		if err = f.Sync(); err != nil {
 			onErr(err)
 			return
 		}
-		stream.WriteRaw(string(strD))
-	}
-	stream.WriteArrayEnd()
-
-	stream.WriteMore()
-	stream.WriteObjectField("files")
-	stream.WriteArrayStart()
-
-	// Write the entries
-	for i, entry := range entries {
-		if i > 0 {
-			stream.WriteMore()
-		}
-		stream.WriteRaw(entry)
 	}
 
-	// Close the array and object
-	stream.WriteArrayEnd()
-	stream.WriteObjectEnd()
-
-	if stream.Error != nil {
-		onErr(stream.Error)
-		return
-	}
-
-	err = stream.Flush()
+	// Rename the backup file to the actual metadata file
+	err = os.Rename(path.Join(J.idxPath, "metadata.json.bak"), path.Join(J.idxPath, "metadata.json"))
 	if err != nil {
 		onErr(err)
 		return
 	}
-
-	// Rename the backup file to the actual metadata file
-	err = os.Rename(path.Join(J.idxPath, "metadata.json.bak"), path.Join(J.idxPath, "metadata.json"))
+	if J.options.Durability != DurabilityNone {
+		if err = syncDir(J.idxPath); err != nil {
+			onErr(err)
+			return
+		}
+	}
+	st, err := os.Stat(path.Join(J.idxPath, "metadata.json"))
 	if err != nil {
 		onErr(err)
 		return
 	}
+	J.m.Lock()
+	J.diskInfo = st
+	J.m.Unlock()
+	if err = J.truncateWAL(walSeq); err != nil {
+		// metadata.json holds the records, they are skipped on replay
+		J.options.onError(fmt.Errorf("truncating the WAL of %s: %w", J.idxPath, err))
+	}
 
 	onErr(nil)
 }
 
+// committed tells if the commit record id was applied to the partition.
+func (J *jsonPartIndex) committed(id string) bool {
+	J.m.Lock()
+	defer J.m.Unlock()
+	return J.commits[id]
+}
+
+// pruneCommits forgets the marks of the removed commit records, they are
+// not applied again. Runs under J.m.
+func (J *jsonPartIndex) pruneCommits() {
+	dir := jsonCommitDir(J.layers, J.database, J.table)
+	for id := range J.commits {
+		if _, err := os.Stat(path.Join(dir, id+".json")); os.IsNotExist(err) {
+			delete(J.commits, id)
+		}
+	}
+}
+
 func (J *jsonPartIndex) Run() {
+	J.done = make(chan struct{})
 	go func() {
+		defer close(J.done)
 		for {
 			select {
 			case <-J.updateCtx.Done():
 
 				J.flush()
 			case <-J.workCtx.Done():
+				J.m.Lock()
+				pending := J.updateCtx.Err() != nil
+				J.m.Unlock()
+				if pending {
+					J.flush()
+				}
 				return
 			}
 		}
 	}()
 }
 
+// Stop writes the pending changes and waits for the flush goroutine to exit.
 func (J *jsonPartIndex) Stop() {
 	J.stop()
+	if J.done != nil {
+		<-J.done
+	}
 }
 
 func (J *jsonPartIndex) jEntry2Entry(_e *jsonIndexEntry) *IndexEntry {
@@ -471,7 +711,11 @@ func (J *jsonPartIndex) jEntry2Entry(_e *jsonIndexEntry) *IndexEntry {
 }
 
 func (J *jsonPartIndex) Get(layer string, path string) *IndexEntry {
-	e, _ := J.entries.Load(path)
+	return J.GetCtx(context.Background(), layer, path)
+}
+
+func (J *jsonPartIndex) GetCtx(ctx context.Context, layer string, path string) *IndexEntry {
+	e, _ := J.loadedEntries().Load(path)
 	if e == nil {
 		return nil
 	}
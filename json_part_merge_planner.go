@@ -1,74 +1,205 @@
 package metadata
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"path"
+	"slices"
 	"strings"
 	"time"
 )
 
+// jsonMergeLease is a merge plan handed out. It is hidden from the planners
+// until TimeS (unix seconds) and handed out again after.
+type jsonMergeLease struct {
+	MergePlan
+	TimeS int64 `json:"time_s"`
+}
+
 func (J *jsonPartIndex) GetMergePlan(writerId string, layer string, iteration int) (MergePlan, error) {
-	suffix := fmt.Sprintf(".%d.parquet", iteration)
-	var from []string
-	var size int64
-	if iteration > len(MergeConfigurations) {
+	return J.GetMergePlanCtx(context.Background(), writerId, layer, iteration)
+}
+
+// GetMergePlanCtx hands out the expired plans of the writer first, then plans
+// the merge of its oldest files of the iteration. The lease is logged before
+// the plan is returned.
+func (J *jsonPartIndex) GetMergePlanCtx(ctx context.Context, writerId string, layer string, iteration int) (MergePlan, error) {
+	if err := ctx.Err(); err != nil {
+		return MergePlan{}, err
+	}
+	if iteration < 1 || iteration > len(J.mergeConfigurations()) {
 		return MergePlan{}, fmt.Errorf("no more merge configurations available for iteration %d", iteration)
 	}
-	conf := MergeConfigurations[iteration-1]
 	now := time.Now()
 	J.m.Lock()
-	defer J.m.Unlock()
-	J.entries.Range(func(key, value interface{}) bool {
-		entry := value.(*jsonIndexEntry)
-		if !strings.HasSuffix(entry.Path, suffix) {
-			return true
+	lease := J.nextMerge(writerId, layer, iteration, now)
+	J.m.Unlock()
+	if lease == nil {
+		return MergePlan{}, nil
+	}
+	err := J.logged(func(rec *jsonWalRecord) {
+		// Another process may have taken the files in the meantime
+		if lease = J.nextMerge(writerId, layer, iteration, now); lease != nil {
+			rec.Merges = append(rec.Merges, *lease)
 		}
-		if J.filesInMerge[entry.Path] {
-			return true
+	})
+	if err != nil || lease == nil {
+		return MergePlan{}, err
+	}
+	// The lease is written by the flush while the caller uses the plan
+	plan := lease.MergePlan
+	plan.From = slices.Clone(plan.From)
+	return plan, nil
+}
+
+// nextMerge returns the lease of the next plan of the writer without taking
+// it. Runs under J.m.
+func (J *jsonPartIndex) nextMerge(writerId string, layer string, iteration int, now time.Time) *jsonMergeLease {
+	expires := now.Unix() + J.options.leaseTimeoutSec()
+	for _, l := range J.merges {
+		if l.WriterID == writerId && l.Iteration == iteration && l.TimeS <= now.Unix() {
+			return &jsonMergeLease{MergePlan: l.MergePlan, TimeS: expires}
 		}
-		if entry.ChunkTime+conf.TimeoutSec()*1000000000 >= now.UnixNano() {
+	}
+	conf := J.mergeConfigurations()[iteration-1]
+	if !J.mergeBeforeMove(conf) {
+		// The files are moved to the next layer before they are due
+		return nil
+	}
+	var candidates []*jsonIndexEntry
+	J.entries.Range(func(key, value any) bool {
+		e := value.(*jsonIndexEntry)
+		if e.WriterID != writerId || pathIteration(e.Path) != iteration ||
+			J.filesInMerge[e.Path] != "" || J.filesInMove[e.Path] != "" {
 			return true
 		}
-		if size > conf[1] {
-			return false
+		if e.ChunkTime+conf.TimeoutSec()*1000000000 >= now.UnixNano() {
+			return true
 		}
-
-		from = append(from, entry.Path)
-		size += entry.SizeBytes
+		candidates = append(candidates, e)
 		return true
 	})
-	for _, file := range from {
-		J.filesInMerge[file] = true
+	slices.SortFunc(candidates, func(a, b *jsonIndexEntry) int {
+		return cmp.Or(cmp.Compare(a.ChunkTime, b.ChunkTime), strings.Compare(a.Path, b.Path))
+	})
+	var from []string
+	var size int64
+	for _, e := range candidates {
+		if len(from) > 0 && size+e.SizeBytes > conf.MaxSize() {
+			break
+		}
+		from = append(from, e.Path)
+		size += e.SizeBytes
+	}
+	if len(from) == 0 {
+		return nil
+	}
+	return &jsonMergeLease{
+		MergePlan: MergePlan{
+			ID:        uuid.New().String(),
+			WriterID:  writerId,
+			Layer:     layer,
+			Database:  J.database,
+			Table:     J.table,
+			From:      from,
+			To:        path.Join(J.partPath, fmt.Sprintf("%s.%d.parquet", uuid.New().String(), iteration+1)),
+			Iteration: iteration,
+		},
+		TimeS: expires,
 	}
-	uid, _ := uuid.NewUUID()
+}
+
+// setMerge adds or renews a lease. Runs under J.m.
+func (J *jsonPartIndex) setMerge(l jsonMergeLease) {
+	J.endMerge(l.ID)
+	J.merges[l.ID] = &l
+	for _, f := range l.From {
+		J.filesInMerge[f] = l.ID
+	}
+}
 
-	tablePath := path.Join(J.rootPath, J.database, J.table, "data") + "/"
-	partPath := J.idxPath[len(tablePath):]
-	return MergePlan{
-		Layer:     layer,
-		Database:  J.database,
-		Table:     J.table,
-		From:      from,
-		To:        path.Join(partPath, fmt.Sprintf("%s.%d.parquet", uid.String(), iteration+1)),
-		Iteration: iteration,
-	}, nil
+// endMerge drops a lease. Runs under J.m.
+func (J *jsonPartIndex) endMerge(id string) {
+	l := J.merges[id]
+	if l == nil {
+		return
+	}
+	for _, f := range l.From {
+		if J.filesInMerge[f] == id {
+			delete(J.filesInMerge, f)
+		}
+	}
+	delete(J.merges, id)
 }
 
 func (J *jsonPartIndex) EndMerge(plan MergePlan) Promise[int32] {
+	return J.EndMergeCtx(context.Background(), plan)
+}
+
+func (J *jsonPartIndex) EndMergeCtx(ctx context.Context, plan MergePlan) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	err := J.logged(func(rec *jsonWalRecord) {
+		if J.merges[plan.ID] != nil {
+			rec.EndMerges = append(rec.EndMerges, plan.ID)
+		}
+	})
+	return Fulfilled(err, int32(0))
+}
+
+func (J *jsonPartIndex) CommitMerge(plan MergePlan, result *IndexEntry) Promise[int32] {
+	return J.CommitMergeCtx(context.Background(), plan, result)
+}
+
+// CommitMergeCtx logs the merged file, the removal and the drop plans of the
+// merged ones and the end of the lease as one record, applied at once.
+// Under DurabilityNone it resolves once flushed.
+func (J *jsonPartIndex) CommitMergeCtx(ctx context.Context, plan MergePlan, result *IndexEntry) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	add, err := J.entry2JEntry([]*IndexEntry{result})
+	if err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	found := false
+	err = J.logged(func(rec *jsonWalRecord) {
+		l := J.merges[plan.ID]
+		if l == nil {
+			return
+		}
+		found = true
+		rm := make([]*IndexEntry, len(l.From))
+		for i, f := range l.From {
+			rm[i] = &IndexEntry{Layer: l.Layer, Database: J.database, Table: J.table, Path: f, WriterID: l.WriterID}
+		}
+		rec.Add = append(rec.Add, json.RawMessage(add[0]._marshalled))
+		rec.Rm = append(rec.Rm, l.From...)
+		rec.Drop = J.newDropPlans(rm)
+		rec.EndMerges = append(rec.EndMerges, plan.ID)
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("merge plan %s is not in progress", plan.ID)
+	}
+	if err != nil {
+		return Fulfilled(err, int32(0))
+	}
 	J.m.Lock()
 	defer J.m.Unlock()
-	update := false
-	for _, file := range plan.From {
-		update = update || J.filesInMerge[file]
-		delete(J.filesInMerge, file)
-	}
-	if !update {
-		return Fulfilled[int32](nil, 0)
+	if J.options.Durability == DurabilityNone {
+		// Like a Batch, it is written by the next flush
+		p := NewPromise[int32]()
+		J.promises = append(J.promises, p)
+		J.doUpdate()
+		return p
 	}
-	p := NewPromise[int32]()
-	J.promises = append(J.promises, p)
-	return p
+	// The commit is durable in the log, metadata.json can catch up later
+	J.doUpdate()
+	return Fulfilled(nil, int32(0))
 }
 
 func (J *jsonPartIndex) GetMergePlanner() TableMergePlanner {
@@ -1,58 +1,150 @@
 package metadata
 
 import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"path"
+	"strings"
 	"time"
 )
 
+// jsonMoveLease is a move plan handed out. It is hidden from the planners
+// until TimeS (unix seconds) and handed out again after.
+type jsonMoveLease struct {
+	MovePlan
+	TimeS int64 `json:"time_s"`
+}
+
 func (J *jsonPartIndex) GetMovePlan(writerId string, layer string) (MovePlan, error) {
+	return J.GetMovePlanCtx(context.Background(), writerId, layer)
+}
+
+// GetMovePlanCtx hands out the expired plans of the writer first, then plans
+// the move of its oldest file past the TTL of the layer. The lease is logged
+// before the plan is returned.
+func (J *jsonPartIndex) GetMovePlanCtx(ctx context.Context, writerId string, layer string) (MovePlan, error) {
+	if err := ctx.Err(); err != nil {
+		return MovePlan{}, err
+	}
+	now := time.Now()
 	J.m.Lock()
-	defer J.m.Unlock()
-	var plan *MovePlan
+	lease := J.nextMove(writerId, now)
+	J.m.Unlock()
+	if lease == nil {
+		return MovePlan{}, nil
+	}
+	err := J.logged(func(rec *jsonWalRecord) {
+		// Another process may have taken it in the meantime
+		if lease = J.nextMove(writerId, now); lease != nil {
+			rec.Moves = append(rec.Moves, *lease)
+		}
+	})
+	if err != nil || lease == nil {
+		return MovePlan{}, err
+	}
+	return lease.MovePlan, nil
+}
+
+// nextMove returns the lease of the next plan of the writer without taking
+// it. Runs under J.m.
+func (J *jsonPartIndex) nextMove(writerId string, now time.Time) *jsonMoveLease {
+	expires := now.Unix() + J.options.leaseTimeoutSec()
+	for _, l := range J.moves {
+		if l.WriterID == writerId && l.TimeS <= now.Unix() {
+			return &jsonMoveLease{MovePlan: l.MovePlan, TimeS: expires}
+		}
+	}
+	i := J.getLayer(J.layer)
+	if i < 0 || J.layers[i].TTLSec <= 0 {
+		return nil
+	}
+	mergeConfigurations := J.mergeConfigurations()
+	var candidate *jsonIndexEntry
 	J.entries.Range(func(key, value any) bool {
-		val := value.(*jsonIndexEntry)
-		if J.filesInMerge[val.Path] {
+		e := value.(*jsonIndexEntry)
+		if e.WriterID != writerId || J.filesInMerge[e.Path] != "" || J.filesInMove[e.Path] != "" {
 			return true
 		}
-		layerTdx := J.getLayer(val.Layer)
-		if layerTdx < 0 {
+		if e.ChunkTime+int64(J.layers[i].TTLSec)*1000000000 > now.UnixNano() {
 			return true
 		}
-		layerTo := ""
-		if layerTdx+1 < len(J.layers) {
-			layerTo = J.layers[layerTdx+1].Name
+		iteration := pathIteration(e.Path)
+		if iteration >= 1 && iteration <= len(mergeConfigurations) &&
+			J.mergeBeforeMove(mergeConfigurations[iteration-1]) {
+			return true
 		}
-		if J.layers[layerTdx].TTLSec > 0 &&
-			time.Now().UnixNano()-val.ChunkTime >= int64(J.layers[layerTdx].TTLSec)*1000000000 {
-			plan = &MovePlan{
-				ID:        "",
-				Database:  J.database,
-				Table:     J.table,
-				PathFrom:  val.Path,
-				LayerFrom: val.Layer,
-				PathTo:    val.Path,
-				LayerTo:   layerTo,
-			}
-			return false
+		if candidate == nil || cmp.Or(cmp.Compare(e.ChunkTime, candidate.ChunkTime),
+			strings.Compare(e.Path, candidate.Path)) < 0 {
+			candidate = e
 		}
 		return true
 	})
-	if plan == nil {
-		return MovePlan{}, nil
+	if candidate == nil {
+		return nil
+	}
+	layerTo := ""
+	if i+1 < len(J.layers) {
+		layerTo = J.layers[i+1].Name
+	}
+	return &jsonMoveLease{
+		MovePlan: MovePlan{
+			ID:        uuid.New().String(),
+			WriterID:  writerId,
+			Database:  J.database,
+			Table:     J.table,
+			PathFrom:  candidate.Path,
+			LayerFrom: J.layer,
+			PathTo: path.Join(J.partPath,
+				fmt.Sprintf("%s.%d.parquet", uuid.New().String(), pathIteration(candidate.Path))),
+			LayerTo: layerTo,
+		},
+		TimeS: expires,
+	}
+}
+
+// mergeBeforeMove tells if the files of the merge configuration are due to
+// be merged rather than moved, the same way patch_index.lua decides it.
+func (J *jsonPartIndex) mergeBeforeMove(conf MergeConfigurationsConf) bool {
+	i := J.getLayer(J.layer)
+	if i < 0 || J.layers[i].TTLSec <= 0 {
+		return true
+	}
+	return conf.TimeoutSec() <= int64(J.layers[i].TTLSec)
+}
+
+// setMove adds or renews a lease. Runs under J.m.
+func (J *jsonPartIndex) setMove(l jsonMoveLease) {
+	if old := J.moves[l.ID]; old != nil {
+		delete(J.filesInMove, old.PathFrom)
+	}
+	J.moves[l.ID] = &l
+	J.filesInMove[l.PathFrom] = l.ID
+}
+
+// endMove drops a lease. Runs under J.m.
+func (J *jsonPartIndex) endMove(id string) {
+	if l := J.moves[id]; l != nil {
+		delete(J.filesInMove, l.PathFrom)
+		delete(J.moves, id)
 	}
-	return *plan, nil
 }
 
 func (J *jsonPartIndex) EndMove(plan MovePlan) Promise[int32] {
-	J.m.Lock()
-	defer J.m.Unlock()
-	if _, ok := J.filesInMove[plan.PathFrom]; !ok {
-		return Fulfilled[int32](nil, 0)
-	}
-	delete(J.filesInMove, plan.PathFrom)
-	p := NewPromise[int32]()
-	J.promises = append(J.promises, p)
-	J.doUpdate()
-	return p
+	return J.EndMoveCtx(context.Background(), plan)
+}
+
+func (J *jsonPartIndex) EndMoveCtx(ctx context.Context, plan MovePlan) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	err := J.logged(func(rec *jsonWalRecord) {
+		if J.moves[plan.ID] != nil {
+			rec.EndMoves = append(rec.EndMoves, plan.ID)
+		}
+	})
+	return Fulfilled(err, int32(0))
 }
 
 func (J *jsonPartIndex) GetMovePlanner() TableMovePlanner {
@@ -0,0 +1,167 @@
+package metadata
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+// jsonPartPending are the changes of this process not flushed yet. When
+// another process rewrote metadata.json in the meantime they are applied
+// again on top of its version instead of overwriting it.
+type jsonPartPending struct {
+	add map[string]*jsonIndexEntry
+	rm  map[string]bool
+	// drop plans added, and removed by id
+	drops   []DropPlan
+	dropped map[string]bool
+	// leases are the lease records not logged under DurabilityNone
+	leases []*jsonWalRecord
+	// commits are the markers of the Batches spanning several partitions
+	// not logged yet
+	commits map[string]bool
+}
+
+func newJsonPartPending() *jsonPartPending {
+	return &jsonPartPending{
+		add:     make(map[string]*jsonIndexEntry),
+		rm:      make(map[string]bool),
+		dropped: make(map[string]bool),
+		commits: make(map[string]bool),
+	}
+}
+
+func (p *jsonPartPending) batch(add []*jsonIndexEntry, rm []*IndexEntry, drops []DropPlan) {
+	for _, e := range add {
+		delete(p.rm, e.Path)
+		p.add[e.Path] = e
+	}
+	for _, e := range rm {
+		delete(p.add, e.Path)
+		p.rm[e.Path] = true
+	}
+	p.drops = append(p.drops, drops...)
+}
+
+// merge puts back the changes of a failed flush under the newer ones.
+func (p *jsonPartPending) merge(newer *jsonPartPending) {
+	p.batch(nil, nil, newer.drops)
+	for k, e := range newer.add {
+		delete(p.rm, k)
+		p.add[k] = e
+	}
+	for k := range newer.rm {
+		delete(p.add, k)
+		p.rm[k] = true
+	}
+	for k := range newer.dropped {
+		p.dropped[k] = true
+	}
+	for k := range newer.commits {
+		p.commits[k] = true
+	}
+	p.leases = append(p.leases, newer.leases...)
+}
+
+// diskChanged tells if metadata.json was replaced since this process last
+// read or wrote it. Every writer renames a new file over it, so a different
+// file means another writer.
+func (J *jsonPartIndex) diskChanged() bool {
+	st, err := os.Stat(path.Join(J.idxPath, "metadata.json"))
+	if err != nil {
+		return J.diskInfo != nil
+	}
+	return J.diskInfo == nil || !sameDiskFile(st, J.diskInfo)
+}
+
+// sameDiskFile tells if a and b are the same version of a file. The inode of
+// a replaced file may be reused by the next one, the time and size tell
+// them apart.
+func sameDiskFile(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// syncFromDisk brings in the changes of the other processes: a rewritten
+// metadata.json or records appended to the write-ahead log. Runs under the
+// partition lock and J.m.
+func (J *jsonPartIndex) syncFromDisk() error {
+	if !J.diskChanged() {
+		return J.replayWAL()
+	}
+	J.entries = &sync.Map{}
+	J.view = nil
+	J.dropQueue = nil
+	J.parquetSizeBytes = 0
+	J.rowCount = 0
+	J.minTime = 0
+	J.maxTime = 0
+	J.iterations = make(map[int]IterationStats)
+	J.memBytes.Store(0)
+	for _, v := range J.old {
+		J.memBytes.Add(v.size)
+	}
+	J.walSeq = 0
+	J.walOffset = 0
+	J.moves = make(map[string]*jsonMoveLease)
+	J.filesInMove = make(map[string]string)
+	J.merges = make(map[string]*jsonMergeLease)
+	J.filesInMerge = make(map[string]string)
+	J.commits = make(map[string]bool)
+	if err := J.populate(); err != nil {
+		return err
+	}
+	add := make([]*jsonIndexEntry, 0, len(J.pending.add))
+	for _, e := range J.pending.add {
+		add = append(add, e)
+	}
+	rm := make([]*IndexEntry, 0, len(J.pending.rm))
+	for p := range J.pending.rm {
+		rm = append(rm, &IndexEntry{Path: p})
+	}
+	J.add(add)
+	J.rm(rm)
+	queued := make(map[string]bool)
+	for _, d := range J.dropQueue {
+		queued[d.ID] = true
+	}
+	for _, d := range J.pending.drops {
+		if !queued[d.ID] {
+			J.dropQueue = append(J.dropQueue, d)
+		}
+	}
+	dropQueue := J.dropQueue[:0]
+	for _, d := range J.dropQueue {
+		if !J.pending.dropped[d.ID] {
+			dropQueue = append(dropQueue, d)
+		}
+	}
+	J.dropQueue = dropQueue
+	for _, rec := range J.pending.leases {
+		if err := J.applyWalRecord(rec); err != nil {
+			return err
+		}
+	}
+	for id := range J.pending.commits {
+		J.commits[id] = true
+	}
+	return nil
+}
+
+// loadedEntries returns the entries map, syncFromDisk replaces it.
+func (J *jsonPartIndex) loadedEntries() *sync.Map {
+	J.m.Lock()
+	defer J.m.Unlock()
+	return J.entries
+}
+
+// refresh reloads the partition if another process changed it. Only the
+// in-process half of the partition lock is taken: a reader may not be
+// allowed to create metadata.lock, and a metadata.json replaced during the
+// reload differs from diskInfo and is read again by the next refresh.
+func (J *jsonPartIndex) refresh() error {
+	J.flock.m.Lock()
+	defer J.flock.m.Unlock()
+	J.m.Lock()
+	defer J.m.Unlock()
+	return J.syncFromDisk()
+}
@@ -0,0 +1,161 @@
+package metadata
+
+import "time"
+
+// jsonPlanDue tells from when, in unix seconds, the planners of each writer
+// may find work in a partition: files to merge by iteration, files to move,
+// drop plans or expired leases. The times are lower bounds: a partition past
+// its time is loaded and planned, the others are skipped. Stamp is when the
+// partition was last summed up, Lowered when the last batch brought its times
+// in (unix nanos).
+type jsonPlanDue struct {
+	Stamp   int64                     `json:"stamp"`
+	Lowered int64                     `json:"lowered,omitempty"`
+	Writers map[string]*jsonWriterDue `json:"writers"`
+}
+
+// jsonWriterDue are the times of a writer, zero is never.
+type jsonWriterDue struct {
+	Merge map[int]int64 `json:"merge,omitempty"`
+	Move  int64         `json:"move,omitempty"`
+	Drop  int64         `json:"drop,omitempty"`
+}
+
+// dueMin is the earliest of two times, zero being never.
+func dueMin(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func newJsonPlanDue(stamp int64) *jsonPlanDue {
+	return &jsonPlanDue{Stamp: stamp, Writers: make(map[string]*jsonWriterDue)}
+}
+
+func (d *jsonPlanDue) writer(id string) *jsonWriterDue {
+	w := d.Writers[id]
+	if w == nil {
+		w = &jsonWriterDue{}
+		d.Writers[id] = w
+	}
+	return w
+}
+
+func (w *jsonWriterDue) lowerMerge(iteration int, s int64) bool {
+	if w.Merge == nil {
+		w.Merge = make(map[int]int64)
+	}
+	cur := w.Merge[iteration]
+	w.Merge[iteration] = dueMin(cur, max(s, 1))
+	return w.Merge[iteration] != cur
+}
+
+func (w *jsonWriterDue) lowerMove(s int64) bool {
+	cur := w.Move
+	w.Move = dueMin(cur, max(s, 1))
+	return w.Move != cur
+}
+
+func (w *jsonWriterDue) lowerDrop(s int64) bool {
+	cur := w.Drop
+	w.Drop = dueMin(cur, max(s, 1))
+	return w.Drop != cur
+}
+
+// lower brings the times of o in and tells if one of them was earlier.
+func (d *jsonPlanDue) lower(o *jsonPlanDue) bool {
+	changed := false
+	for id, ow := range o.Writers {
+		w := d.writer(id)
+		for it, s := range ow.Merge {
+			changed = w.lowerMerge(it, s) || changed
+		}
+		if ow.Move != 0 {
+			changed = w.lowerMove(ow.Move) || changed
+		}
+		if ow.Drop != 0 {
+			changed = w.lowerDrop(ow.Drop) || changed
+		}
+	}
+	return changed
+}
+
+func (d *jsonPlanDue) clone() *jsonPlanDue {
+	res := newJsonPlanDue(d.Stamp)
+	res.Lowered = d.Lowered
+	res.lower(d)
+	return res
+}
+
+// merge combines two summaries of a partition. One summed up after all the
+// changes the other holds replaces it, otherwise the earliest times are kept.
+func (d *jsonPlanDue) merge(o *jsonPlanDue) *jsonPlanDue {
+	switch {
+	case o == nil:
+		return d
+	case d == nil || (o.Stamp > d.Stamp && o.Stamp > d.Lowered):
+		return o.clone()
+	case d.Stamp > o.Stamp && d.Stamp > o.Lowered:
+		return d
+	}
+	res := d.clone()
+	res.lower(o)
+	res.Stamp, res.Lowered = max(d.Stamp, o.Stamp), max(d.Lowered, o.Lowered)
+	return res
+}
+
+// entryDue lowers the times of the writer of the entry: the file is merged
+// once its merge timeout is past, or moved once the TTL of the layer is.
+func (J *jsonPartIndex) entryDue(d *jsonPlanDue, e *IndexEntry) {
+	w := d.writer(e.WriterID)
+	chunkS := e.ChunkTime / int64(time.Second)
+	confs := J.mergeConfigurations()
+	if it := pathIteration(e.Path); it >= 1 && it <= len(confs) {
+		w.lowerMerge(it, chunkS+confs[it-1].TimeoutSec())
+		if J.mergeBeforeMove(confs[it-1]) {
+			return
+		}
+	}
+	if i := J.getLayer(J.layer); i >= 0 && J.layers[i].TTLSec > 0 {
+		w.lowerMove(chunkS + int64(J.layers[i].TTLSec))
+	}
+}
+
+// batchDue are the times a batch may bring forward: its files and the drop
+// plans of the removed ones, queued after now.
+func (J *jsonPartIndex) batchDue(add []*IndexEntry, rm []*IndexEntry, now time.Time) *jsonPlanDue {
+	res := newJsonPlanDue(0)
+	for _, e := range add {
+		J.entryDue(res, e)
+	}
+	for _, e := range rm {
+		res.writer(e.WriterID).lowerDrop(now.Unix() + J.options.dropDelaySec())
+	}
+	return res
+}
+
+// planDue sums up the work of the partition for the manifest: the files
+// not leased, the leases and the drop plans.
+func (J *jsonPartIndex) planDue(stamp int64) *jsonPlanDue {
+	J.m.Lock()
+	defer J.m.Unlock()
+	res := newJsonPlanDue(stamp)
+	J.entries.Range(func(key, value any) bool {
+		e := value.(*jsonIndexEntry)
+		if J.filesInMerge[e.Path] == "" && J.filesInMove[e.Path] == "" {
+			J.entryDue(res, &e.IndexEntry)
+		}
+		return true
+	})
+	for _, l := range J.merges {
+		res.writer(l.WriterID).lowerMerge(l.Iteration, l.TimeS)
+	}
+	for _, l := range J.moves {
+		res.writer(l.WriterID).lowerMove(l.TimeS)
+	}
+	for _, d := range J.dropQueue {
+		res.writer(d.WriterID).lowerDrop(int64(d.TimeS))
+	}
+	return res
+}
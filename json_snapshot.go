@@ -0,0 +1,185 @@
+package metadata
+
+import (
+	"context"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// jsonPartView is the immutable state of a partition read by the queries:
+// its entries and the counters that match them.
+type jsonPartView struct {
+	entries []*jsonIndexEntry
+	stats   *PartitionStats
+	// until is the change of the table that replaced a kept view, size is
+	// counted in the memBytes of the partition
+	until uint64
+	size  int64
+}
+
+// snapshot returns the view of the current state of the partition. It is
+// built by the first reader after a change and shared until the next one.
+func (J *jsonPartIndex) snapshot() *jsonPartView {
+	J.m.Lock()
+	defer J.m.Unlock()
+	return J.currentView()
+}
+
+// snapshotAt returns the view of the partition for a reader started at the
+// change seq of the table.
+func (J *jsonPartIndex) snapshotAt(seq uint64) *jsonPartView {
+	J.m.Lock()
+	defer J.m.Unlock()
+	if J.changed > seq {
+		for _, v := range J.old {
+			if seq < v.until {
+				return v
+			}
+		}
+	}
+	return J.currentView()
+}
+
+// currentView runs under J.m.
+func (J *jsonPartIndex) currentView() *jsonPartView {
+	if J.view != nil {
+		return J.view
+	}
+	view := &jsonPartView{stats: J.statsLocked()}
+	J.entries.Range(func(key, value any) bool {
+		view.entries = append(view.entries, value.(*jsonIndexEntry))
+		return true
+	})
+	slices.SortFunc(view.entries, func(a, b *jsonIndexEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	// The entries are counted already, the view adds a pointer to each
+	view.size = int64(len(view.entries)) * 8
+	J.memBytes.Add(view.size)
+	J.view = view
+	return view
+}
+
+// dropView forgets the current view after a change. Runs under J.m.
+func (J *jsonPartIndex) dropView() {
+	if J.view != nil {
+		J.memBytes.Add(-J.view.size)
+		J.view = nil
+	}
+}
+
+// keepView keeps the view of the partition before the change seq of the
+// table for the readers started earlier. Runs under JSONIndex.lock.
+func (J *jsonPartIndex) keepView(seq uint64) {
+	J.m.Lock()
+	defer J.m.Unlock()
+	cur := J.currentView()
+	kept := &jsonPartView{entries: cur.entries, stats: cur.stats, until: seq, size: cur.size}
+	// The entries the change removes are only held by the kept view
+	for _, e := range kept.entries {
+		kept.size += int64(len(e._marshalled))
+	}
+	J.memBytes.Add(kept.size)
+	J.old = append(J.old, kept)
+	J.changed = seq
+}
+
+// pruneViews drops the kept views no reader started at oldest or later
+// reads. Runs under JSONIndex.lock.
+func (J *jsonPartIndex) pruneViews(oldest uint64) {
+	J.m.Lock()
+	defer J.m.Unlock()
+	old := J.old[:0]
+	for _, v := range J.old {
+		if v.until > oldest {
+			old = append(old, v)
+		} else {
+			J.memBytes.Add(-v.size)
+		}
+	}
+	clear(J.old[len(old):])
+	J.old = old
+}
+
+// change numbers a change of the partitions and keeps their views for the
+// open readers. Runs under J.lock, before the partitions change.
+func (J *JSONIndex) change(parts ...*jsonPartIndex) {
+	J.seq++
+	if len(J.readers) == 0 {
+		return
+	}
+	for _, p := range parts {
+		p.keepView(J.seq)
+		J.keeping[p] = true
+	}
+}
+
+// endRead closes the reader started at seq and drops the views no reader
+// needs anymore.
+func (J *JSONIndex) endRead(seq uint64) {
+	J.lock.Lock()
+	defer J.lock.Unlock()
+	if J.readers[seq]--; J.readers[seq] == 0 {
+		delete(J.readers, seq)
+	}
+	oldest := J.seq
+	for s := range J.readers {
+		oldest = min(oldest, s)
+	}
+	for p := range J.keeping {
+		p.pruneViews(oldest)
+		if len(p.old) == 0 {
+			delete(J.keeping, p)
+		}
+	}
+}
+
+// snapshot yields the views of the partitions of the query, every partition
+// if options is nil, as of the last change applied when it starts. The
+// views are taken one by one while the caller iterates, without any lock
+// held in between: a partition changed since the start is read from the
+// view it kept, so a Batch spanning several partitions is seen whole or not
+// at all.
+func (J *JSONIndex) snapshot(ctx context.Context, options *QueryOptions) iter.Seq2[*jsonPartView, error] {
+	return func(yield func(*jsonPartView, error) bool) {
+		J.lock.Lock()
+		seq := J.seq
+		J.readers[seq]++
+		J.lock.Unlock()
+		defer J.endRead(seq)
+		for _, l := range J.layers {
+			if l.Path == "" || (options != nil && !options.hasLayer(l.Name)) {
+				continue
+			}
+			// A partition created later has an empty view kept
+			var dirs []string
+			var err error
+			if options == nil {
+				J.lock.Lock()
+				dirs, err = J.partitionDirs(ctx, l.Name)
+				J.lock.Unlock()
+			} else {
+				dirs, err = J.manifests[l.Name].dirs(options, J.options.partitionScheme())
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, dir := range dirs {
+				if err := ctx.Err(); err != nil {
+					yield(nil, err)
+					return
+				}
+				p, err := J.load(l.Name, dir)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if !yield(p.snapshotAt(seq), nil) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+)
+
+const walFileName = "metadata.wal"
+
+// jsonWalRecord is a line of metadata.wal: a Batch of the partition with the
+// drop plans it created, or the changes of a flush in delta mode. Seq grows
+// by one per record, metadata.json stores the last Seq it contains as
+// wal_sequence.
+type jsonWalRecord struct {
+	Seq  uint64            `json:"seq"`
+	Add  []json.RawMessage `json:"add,omitempty"`
+	Rm   []string          `json:"rm,omitempty"`
+	Drop []DropPlan        `json:"drop,omitempty"`
+	// Dropped are the ids of the drop plans removed from the queue,
+	// DropLeases the plans handed out with their new TimeS
+	Dropped    []string   `json:"dropped,omitempty"`
+	DropLeases []DropPlan `json:"drop_leases,omitempty"`
+	// Moves are the move leases granted or renewed, EndMoves the ids of the
+	// ended ones
+	Moves    []jsonMoveLease `json:"moves,omitempty"`
+	EndMoves []string        `json:"end_moves,omitempty"`
+	// Merges and EndMerges are the same for the merge leases
+	Merges    []jsonMergeLease `json:"merges,omitempty"`
+	EndMerges []string         `json:"end_merges,omitempty"`
+	// Commits are the ids of the Batches spanning several partitions the
+	// record applies
+	Commits []string `json:"commits,omitempty"`
+}
+
+func (r *jsonWalRecord) empty() bool {
+	return len(r.Add) == 0 && len(r.Rm) == 0 && len(r.Drop) == 0 && len(r.Dropped) == 0 && len(r.DropLeases) == 0 &&
+		len(r.Moves) == 0 && len(r.EndMoves) == 0 && len(r.Merges) == 0 && len(r.EndMerges) == 0 && len(r.Commits) == 0
+}
+
+// appendWAL writes the changes to the log. It runs under J.m.
+func (J *jsonPartIndex) appendWAL(add []*jsonIndexEntry, rm []*IndexEntry, drops []DropPlan, dropped []string,
+	commits []string) error {
+	rec := jsonWalRecord{Drop: drops, Dropped: dropped, Commits: commits}
+	for _, e := range add {
+		rec.Add = append(rec.Add, json.RawMessage(e._marshalled))
+	}
+	for _, e := range rm {
+		rec.Rm = append(rec.Rm, e.Path)
+	}
+	return J.appendRecord(&rec)
+}
+
+// logged runs a change of the planners on the latest state of the
+// partition: fill describes it in a record, which is logged and then
+// applied like a replayed one. Under DurabilityNone the record is applied
+// and kept with the pending changes instead, the next flush writes it like a
+// Batch.
+func (J *jsonPartIndex) logged(fill func(rec *jsonWalRecord)) error {
+	if J.options.Durability == DurabilityNone {
+		return J.pended(fill)
+	}
+	unlock, err := J.flock.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	J.m.Lock()
+	defer J.m.Unlock()
+	if err = J.syncFromDisk(); err != nil {
+		return err
+	}
+	var rec jsonWalRecord
+	fill(&rec)
+	if rec.empty() {
+		return nil
+	}
+	if err = J.appendRecord(&rec); err != nil {
+		return err
+	}
+	return J.applyWalRecord(&rec)
+}
+
+func (J *jsonPartIndex) pended(fill func(rec *jsonWalRecord)) error {
+	J.m.Lock()
+	defer J.m.Unlock()
+	var rec jsonWalRecord
+	fill(&rec)
+	if rec.empty() {
+		return nil
+	}
+	add, err := walEntries(rec.Add)
+	if err != nil {
+		return err
+	}
+	if err = J.applyWalRecord(&rec); err != nil {
+		return err
+	}
+	rm := make([]*IndexEntry, len(rec.Rm))
+	for i, p := range rec.Rm {
+		rm[i] = &IndexEntry{Path: p}
+	}
+	J.pending.batch(add, rm, rec.Drop)
+	for _, id := range rec.Dropped {
+		J.pending.dropped[id] = true
+	}
+	leases := jsonWalRecord{DropLeases: rec.DropLeases, Moves: rec.Moves, EndMoves: rec.EndMoves,
+		Merges: rec.Merges, EndMerges: rec.EndMerges}
+	if !leases.empty() {
+		J.pending.leases = append(J.pending.leases, &leases)
+	}
+	J.doUpdate()
+	return nil
+}
+
+// appendRecord numbers the record, writes it to the log and, unless the
+// durability is DurabilityNone, syncs it. It runs under J.m.
+func (J *jsonPartIndex) appendRecord(rec *jsonWalRecord) error {
+	rec.Seq = J.walSeq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(J.idxPath, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = cutTornRecord(f); err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if J.options.Durability != DurabilityNone {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	// The log was replayed up to its end before the record
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	J.walSeq = rec.Seq
+	J.walOffset = st.Size()
+	return nil
+}
+
+// appendDelta logs the changes of a flush in delta mode and tells if the log
+// is large enough to be checkpointed into metadata.json. Runs under J.m.
+func (J *jsonPartIndex) appendDelta(p *jsonPartPending) (bool, error) {
+	var add []*jsonIndexEntry
+	var rm []*IndexEntry
+	var drops []DropPlan
+	if J.options.Durability != DurabilityWAL {
+		// In WAL mode the batches are in the log already
+		for _, e := range p.add {
+			add = append(add, e)
+		}
+		for k := range p.rm {
+			rm = append(rm, &IndexEntry{Path: k})
+		}
+		drops = p.drops
+	}
+	var dropped []string
+	for k := range p.dropped {
+		dropped = append(dropped, k)
+	}
+	var commits []string
+	for k := range p.commits {
+		commits = append(commits, k)
+	}
+	if len(add) > 0 || len(rm) > 0 || len(drops) > 0 || len(dropped) > 0 || len(commits) > 0 {
+		if err := J.appendWAL(add, rm, drops, dropped, commits); err != nil {
+			return false, err
+		}
+	}
+	for _, rec := range p.leases {
+		if err := J.appendRecord(rec); err != nil {
+			return false, err
+		}
+	}
+	// The changes are logged, a failed stat only delays the checkpoint
+	size, err := J.walSize()
+	return err == nil && size >= J.options.CheckpointBytes, nil
+}
+
+// walSize is the size of the log, 0 if there is none.
+func (J *jsonPartIndex) walSize() (int64, error) {
+	st, err := os.Stat(path.Join(J.idxPath, walFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// replayWAL applies the records newer than metadata.json, from walOffset on.
+// A last line without its newline is a write torn by a crash, its Batch was
+// never acknowledged and is ignored.
+func (J *jsonPartIndex) replayWAL() error {
+	f, err := os.Open(path.Join(J.idxPath, walFileName))
+	if os.IsNotExist(err) {
+		J.walOffset = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() < J.walOffset {
+		// Truncated since, the records metadata.json holds are skipped
+		J.walOffset = 0
+	}
+	if _, err = f.Seek(J.walOffset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec jsonWalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("%s: corrupted record: %w", path.Join(J.idxPath, walFileName), err)
+		}
+		if rec.Seq > J.walSeq {
+			if err := J.applyWalRecord(&rec); err != nil {
+				return err
+			}
+			J.walSeq = rec.Seq
+		}
+		J.walOffset += int64(len(line))
+	}
+}
+
+// walEntries decodes the entries added by a record.
+func walEntries(raw []json.RawMessage) ([]*jsonIndexEntry, error) {
+	res := make([]*jsonIndexEntry, len(raw))
+	for i, r := range raw {
+		e := &jsonIndexEntry{}
+		if err := json.Unmarshal(r, e); err != nil {
+			return nil, err
+		}
+		e._marshalled = string(r)
+		res[i] = e
+	}
+	return res, nil
+}
+
+func (J *jsonPartIndex) applyWalRecord(rec *jsonWalRecord) error {
+	add, err := walEntries(rec.Add)
+	if err != nil {
+		return err
+	}
+	for _, e := range add {
+		J.lastId = max(J.lastId, e.Id)
+	}
+	rm := make([]*IndexEntry, len(rec.Rm))
+	for i, p := range rec.Rm {
+		rm[i] = &IndexEntry{Path: p}
+	}
+	J.add(add)
+	J.rm(rm)
+	J.dropQueue = append(J.dropQueue, rec.Drop...)
+	if len(rec.Dropped) > 0 {
+		J.dropQueue = slices.DeleteFunc(J.dropQueue, func(d DropPlan) bool {
+			return slices.Contains(rec.Dropped, d.ID)
+		})
+	}
+	for _, d := range rec.DropLeases {
+		J.leaseDrop(d)
+	}
+	for _, l := range rec.Moves {
+		J.setMove(l)
+	}
+	for _, id := range rec.EndMoves {
+		J.endMove(id)
+	}
+	for _, l := range rec.Merges {
+		J.setMerge(l)
+	}
+	for _, id := range rec.EndMerges {
+		J.endMerge(id)
+	}
+	for _, id := range rec.Commits {
+		J.commits[id] = true
+	}
+	return nil
+}
+
+// cutTornRecord removes the partial last line left by a crash, the next
+// record would be appended to it otherwise. Runs under the partition lock.
+func cutTornRecord(f *os.File) error {
+	st, err := f.Stat()
+	if err != nil || st.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, st.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	// Only a torn log is read, backwards up to its last complete record
+	buf := make([]byte, 64*1024)
+	for end := st.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err = f.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return f.Truncate(start + int64(i) + 1)
+		}
+		end = start
+	}
+	return f.Truncate(0)
+}
+
+// truncateWAL empties the log once metadata.json holds every record of it.
+func (J *jsonPartIndex) truncateWAL(seq uint64) error {
+	J.m.Lock()
+	defer J.m.Unlock()
+	if J.walSeq != seq {
+		// Newer batches are only in the log, replay skips the old records
+		return nil
+	}
+	err := os.Truncate(path.Join(J.idxPath, walFileName), 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		J.walOffset = 0
+	}
+	return err
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,97 @@
+package metadata
+
+import (
+	"context"
+)
+
+type memDBIndex struct {
+	s *MemStorage
+}
+
+func NewMemDBIndex(storage *MemStorage) DBIndex {
+	return &memDBIndex{s: storage}
+}
+
+// tables returns the tables of the database holding at least one file,
+// the same way Redis only keeps the folders: hash of non-empty tables.
+func (m *memDBIndex) tables(database string) map[string]*memTable {
+	m.s.m.Lock()
+	defer m.s.m.Unlock()
+	res := make(map[string]*memTable)
+	for name, t := range m.s.tables[database] {
+		t.m.RLock()
+		for _, l := range t.parts {
+			if len(l) > 0 {
+				res[name] = t
+				break
+			}
+		}
+		t.m.RUnlock()
+	}
+	return res
+}
+
+func (m *memDBIndex) Databases() ([]string, error) {
+	return m.DatabasesCtx(context.Background())
+}
+
+func (m *memDBIndex) DatabasesCtx(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.s.m.Lock()
+	databases := make([]string, 0, len(m.s.tables))
+	for db := range m.s.tables {
+		databases = append(databases, db)
+	}
+	m.s.m.Unlock()
+	var res []string
+	for _, db := range databases {
+		if len(m.tables(db)) > 0 {
+			res = append(res, db)
+		}
+	}
+	return res, nil
+}
+
+func (m *memDBIndex) Tables(database string) ([]string, error) {
+	return m.TablesCtx(context.Background(), database)
+}
+
+func (m *memDBIndex) TablesCtx(ctx context.Context, database string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var res []string
+	for name := range m.tables(database) {
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+func (m *memDBIndex) Paths(database string, table string) ([]string, error) {
+	return m.PathsCtx(context.Background(), database, table)
+}
+
+func (m *memDBIndex) PathsCtx(ctx context.Context, database string, table string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := m.tables(database)[table]
+	if t == nil {
+		return nil, nil
+	}
+	t.m.RLock()
+	defer t.m.RUnlock()
+	paths := make(map[string]bool)
+	for _, l := range t.parts {
+		for dir := range l {
+			paths[dir] = true
+		}
+	}
+	res := make([]string, 0, len(paths))
+	for p := range paths {
+		res = append(res, p)
+	}
+	return res, nil
+}
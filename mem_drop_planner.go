@@ -0,0 +1,49 @@
+package metadata
+
+import (
+	"context"
+	"time"
+)
+
+func (m *memIndex) GetDropPlanner() TableDropPlanner {
+	return m
+}
+
+func (m *memIndex) GetDropQueue(writerId string, layer string) (DropPlan, error) {
+	return m.GetDropQueueCtx(context.Background(), writerId, layer)
+}
+
+func (m *memIndex) GetDropQueueCtx(ctx context.Context, writerId string, layer string) (DropPlan, error) {
+	if err := ctx.Err(); err != nil {
+		return DropPlan{}, err
+	}
+	now := time.Now()
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	for _, d := range m.t.drops {
+		if d.WriterID != writerId || d.Layer != layer || int64(d.TimeS) > now.Unix() {
+			continue
+		}
+		// The plan stays hidden while it is processed, like a processing item in Redis
+		d.TimeS = int32(now.Add(m.options.leaseTimeout()).Unix())
+		return *d, nil
+	}
+	return DropPlan{}, nil
+}
+
+func (m *memIndex) RmFromDropQueue(plan DropPlan) Promise[int32] {
+	return m.RmFromDropQueueCtx(context.Background(), plan)
+}
+
+func (m *memIndex) RmFromDropQueueCtx(ctx context.Context, plan DropPlan) Promise[int32] {
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	for i, d := range m.t.drops {
+		if d.ID != plan.ID {
+			continue
+		}
+		m.t.drops = append(m.t.drops[:i], m.t.drops[i+1:]...)
+		break
+	}
+	return Fulfilled[int32](nil, 0)
+}
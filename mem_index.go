@@ -0,0 +1,303 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"iter"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStorage is the shared in-process state of the in-memory backend.
+// Every index, DB index and KV store created over the same MemStorage sees
+// the same data, like the indexes opened over the same Redis or directory.
+type MemStorage struct {
+	m      sync.Mutex
+	tables map[string]map[string]*memTable
+	kv     map[string][]byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		tables: make(map[string]map[string]*memTable),
+		kv:     make(map[string][]byte),
+	}
+}
+
+func (s *MemStorage) table(database string, table string) *memTable {
+	s.m.Lock()
+	defer s.m.Unlock()
+	db := s.tables[database]
+	if db == nil {
+		db = make(map[string]*memTable)
+		s.tables[database] = db
+	}
+	t := db[table]
+	if t == nil {
+		t = &memTable{
+			parts:  make(map[string]map[string]map[string]*IndexEntry),
+			merges: make(map[string]*memLease[MergePlan]),
+			moves:  make(map[string]*memLease[MovePlan]),
+			leased: make(map[memKey]string),
+		}
+		db[table] = t
+	}
+	return t
+}
+
+// pathIteration returns the merge iteration encoded in the file name
+// (<name>.<iteration>.parquet) or 0 if there is none.
+func pathIteration(_path string) int {
+	name, ok := strings.CutSuffix(path.Base(_path), ".parquet")
+	if !ok || path.Ext(name) == "" {
+		return 0
+	}
+	iteration, err := strconv.Atoi(path.Ext(name)[1:])
+	if err != nil {
+		return 0
+	}
+	return iteration
+}
+
+type memKey struct {
+	layer string
+	path  string
+}
+
+type memLease[T any] struct {
+	plan    T
+	expires time.Time
+}
+
+type memTable struct {
+	m sync.RWMutex
+	// layer -> partition dir -> path -> entry
+	parts  map[string]map[string]map[string]*IndexEntry
+	merges map[string]*memLease[MergePlan]
+	moves  map[string]*memLease[MovePlan]
+	drops  []*DropPlan
+	// files handed out in a merge or move plan -> plan id
+	leased map[memKey]string
+}
+
+type memIndex struct {
+	database string
+	table    string
+	layers   []Layer
+	options  IndexOptions
+	t        *memTable
+}
+
+var _ TableIndex = &memIndex{}
+
+func NewMemIndex(storage *MemStorage, database string, table string, layers []Layer) (TableIndex, error) {
+	return NewMemIndexWithOptions(storage, database, table, layers, IndexOptions{})
+}
+
+func NewMemIndexWithOptions(storage *MemStorage, database string, table string, layers []Layer,
+	options IndexOptions) (TableIndex, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("mem storage is nil")
+	}
+	return &memIndex{
+		database: database,
+		table:    table,
+		layers:   layers,
+		options:  options,
+		t:        storage.table(database, table),
+	}, nil
+}
+
+func (m *memIndex) getLayer(name string) int {
+	for i, layer := range m.layers {
+		if layer.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memIndex) mergeConfigurations(layer string) []MergeConfigurationsConf {
+	if i := m.getLayer(layer); i >= 0 {
+		return m.options.mergeConfigurations(&m.layers[i])
+	}
+	return m.options.mergeConfigurations(nil)
+}
+
+func (m *memIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return m.BatchCtx(context.Background(), add, rm)
+}
+
+func (m *memIndex) BatchCtx(ctx context.Context, add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	for _, e := range slices.Concat(add, rm) {
+		if m.getLayer(e.Layer) < 0 {
+			return Fulfilled[int32](fmt.Errorf("layer \"%s\" not found", e.Layer), 0)
+		}
+	}
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	m.add(add)
+	m.rm(rm)
+	return Fulfilled(nil, int32(0))
+}
+
+func (m *memIndex) add(entries []*IndexEntry) {
+	for _, e := range entries {
+		layer := m.t.parts[e.Layer]
+		if layer == nil {
+			layer = make(map[string]map[string]*IndexEntry)
+			m.t.parts[e.Layer] = layer
+		}
+		dir := path.Dir(e.Path)
+		part := layer[dir]
+		if part == nil {
+			part = make(map[string]*IndexEntry)
+			layer[dir] = part
+		}
+		_e := *e
+		part[e.Path] = &_e
+	}
+}
+
+func (m *memIndex) rm(entries []*IndexEntry) {
+	now := time.Now()
+	for _, e := range entries {
+		dir := path.Dir(e.Path)
+		if part := m.t.parts[e.Layer][dir]; part != nil {
+			delete(part, e.Path)
+			if len(part) == 0 {
+				delete(m.t.parts[e.Layer], dir)
+			}
+		}
+		// Like the other backends the file is queued for dropping even if
+		// it was not indexed
+		m.t.drops = append(m.t.drops, &DropPlan{
+			ID:       uuid.New().String(),
+			WriterID: e.WriterID,
+			Layer:    e.Layer,
+			Database: m.database,
+			Table:    m.table,
+			Path:     e.Path,
+			TimeS:    int32(now.Unix() + m.options.dropDelaySec()),
+		})
+	}
+}
+
+func (m *memIndex) Get(layer string, path string) *IndexEntry {
+	return m.GetCtx(context.Background(), layer, path)
+}
+
+func (m *memIndex) GetCtx(ctx context.Context, layer string, _path string) *IndexEntry {
+	m.t.m.RLock()
+	defer m.t.m.RUnlock()
+	e := m.t.parts[layer][path.Dir(_path)][_path]
+	if e == nil {
+		return nil
+	}
+	_e := *e
+	return &_e
+}
+
+func (m *memIndex) GetAll() ([]*IndexEntry, error) {
+	return m.GetAllCtx(context.Background())
+}
+
+func (m *memIndex) GetAllCtx(ctx context.Context) ([]*IndexEntry, error) {
+	return collectEntries(m.GetAllIter(ctx))
+}
+
+func (m *memIndex) GetAllIter(ctx context.Context) iter.Seq2[*IndexEntry, error] {
+	return m.iterate(ctx, nil)
+}
+
+// iterate copies one partition at a time so the consumer can call back into
+// the index while iterating.
+func (m *memIndex) iterate(ctx context.Context, options *QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		m.t.m.RLock()
+		var keys []memKey
+		for layer, parts := range m.t.parts {
+			if options != nil && !options.hasLayer(layer) {
+				continue
+			}
+			for dir := range parts {
+				if options != nil && !options.matchPartition(m.options.partitionScheme(), dir) {
+					continue
+				}
+				keys = append(keys, memKey{layer: layer, path: dir})
+			}
+		}
+		m.t.m.RUnlock()
+		for _, k := range keys {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			m.t.m.RLock()
+			var part []*IndexEntry
+			for _, e := range m.t.parts[k.layer][k.path] {
+				if options != nil && !options.match(e) {
+					continue
+				}
+				_e := *e
+				part = append(part, &_e)
+			}
+			m.t.m.RUnlock()
+			for _, e := range part {
+				if !yield(e, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *memIndex) GetQuerier() TableQuerier {
+	return m
+}
+
+func (m *memIndex) GetStats() TableStats {
+	return m
+}
+
+func (m *memIndex) Stats() ([]*LayerStats, error) {
+	return m.StatsCtx(context.Background())
+}
+
+func (m *memIndex) StatsCtx(ctx context.Context) ([]*LayerStats, error) {
+	var layers []string
+	for _, l := range m.layers {
+		layers = append(layers, l.Name)
+	}
+	return statsFromEntries(layers, m.GetAllIter(ctx))
+}
+
+func (m *memIndex) Query(options QueryOptions) ([]*IndexEntry, error) {
+	return m.QueryCtx(context.Background(), options)
+}
+
+func (m *memIndex) QueryCtx(ctx context.Context, options QueryOptions) ([]*IndexEntry, error) {
+	return collectEntries(m.QueryIter(ctx, options))
+}
+
+func (m *memIndex) QueryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return options.ordered(m.queryIter(ctx, options))
+}
+
+func (m *memIndex) queryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return m.iterate(ctx, &options)
+}
+
+func (m *memIndex) Run() {
+}
+
+func (m *memIndex) Stop() {
+}
@@ -0,0 +1,86 @@
+package metadata
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemIndex(t *testing.T) {
+	storage := NewMemStorage()
+	idx, err := NewMemIndexWithOptions(storage, "default", "test", []Layer{
+		{URL: "mem://", Name: "l1", Type: "mem"},
+	}, IndexOptions{
+		MergeConfigurations: []MergeConfigurationsConf{{0, 2500, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*IndexEntry
+	for i := 0; i < 4; i++ {
+		ents = append(ents, &IndexEntry{
+			Layer:     "l1",
+			Database:  "default",
+			Table:     "test",
+			Path:      fmt.Sprintf("date=2024-01-15/hour=14/%d.1.parquet", i),
+			SizeBytes: 1000,
+			MinTime:   time.Date(2024, 1, 15, 14, i, 0, 0, time.UTC).UnixNano(),
+			MaxTime:   time.Date(2024, 1, 15, 14, i+1, 0, 0, time.UTC).UnixNano(),
+			ChunkTime: time.Now().Add(-time.Minute).UnixNano(),
+		})
+	}
+	if _, err = idx.Batch(ents, nil).Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := idx.GetQuerier().Query(QueryOptions{
+		After:  time.Date(2024, 1, 15, 14, 2, 30, 0, time.UTC),
+		Before: time.Date(2024, 1, 15, 15, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(res))
+	}
+
+	plan, err := idx.GetMergePlanner().GetMergePlan("", "l1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.From) != 2 {
+		t.Fatalf("expected 2 files in the plan, got %d", len(plan.From))
+	}
+	next, err := idx.GetMergePlanner().GetMergePlan("", "l1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.From) != 2 || next.From[0] == plan.From[0] {
+		t.Fatalf("expected the 2 files not in the first plan, got %v", next.From)
+	}
+	if _, err = idx.GetMergePlanner().EndMerge(plan).Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = idx.Batch(nil, ents[:1]).Get(); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Get("l1", ents[0].Path) != nil {
+		t.Fatalf("%s is still in the index", ents[0].Path)
+	}
+	drop, err := idx.GetDropPlanner().GetDropQueue("", "l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drop.Path != "" {
+		t.Fatalf("%s handed out before the drop delay", drop.Path)
+	}
+
+	dbs, err := NewMemDBIndex(storage).Paths("default", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs) != 1 || dbs[0] != "date=2024-01-15/hour=14" {
+		t.Fatalf("unexpected paths %v", dbs)
+	}
+}
@@ -0,0 +1,58 @@
+package metadata
+
+import (
+	"context"
+	"slices"
+)
+
+type memKVStoreIndex struct {
+	s *MemStorage
+}
+
+func NewMemKVStore(storage *MemStorage) KVStoreIndex {
+	return &memKVStoreIndex{s: storage}
+}
+
+func (m *memKVStoreIndex) Get(key string) ([]byte, error) {
+	return m.GetCtx(context.Background(), key)
+}
+
+func (m *memKVStoreIndex) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.s.m.Lock()
+	defer m.s.m.Unlock()
+	return slices.Clone(m.s.kv[key]), nil
+}
+
+func (m *memKVStoreIndex) Put(key string, value []byte) error {
+	return m.PutCtx(context.Background(), key, value)
+}
+
+func (m *memKVStoreIndex) PutCtx(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.s.m.Lock()
+	defer m.s.m.Unlock()
+	m.s.kv[key] = slices.Clone(value)
+	return nil
+}
+
+func (m *memKVStoreIndex) Delete(key string) error {
+	return m.DeleteCtx(context.Background(), key)
+}
+
+func (m *memKVStoreIndex) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.s.m.Lock()
+	defer m.s.m.Unlock()
+	delete(m.s.kv, key)
+	return nil
+}
+
+func (m *memKVStoreIndex) Destroy() {
+}
@@ -0,0 +1,163 @@
+package metadata
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+func (m *memIndex) GetMergePlanner() TableMergePlanner {
+	return m
+}
+
+func (m *memIndex) GetMergePlan(writerId string, layer string, iteration int) (MergePlan, error) {
+	return m.GetMergePlanCtx(context.Background(), writerId, layer, iteration)
+}
+
+func (m *memIndex) GetMergePlanCtx(ctx context.Context, writerId string, layer string, iteration int) (MergePlan, error) {
+	if err := ctx.Err(); err != nil {
+		return MergePlan{}, err
+	}
+	mergeConfigurations := m.mergeConfigurations(layer)
+	if iteration < 1 || iteration > len(mergeConfigurations) {
+		return MergePlan{}, fmt.Errorf("no more merge configurations available for iteration %d", iteration)
+	}
+	conf := mergeConfigurations[iteration-1]
+	now := time.Now()
+
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+
+	// Re-deliver the plans whose lease has expired first
+	for _, l := range m.t.merges {
+		if l.plan.WriterID != writerId || l.plan.Layer != layer || l.plan.Iteration != iteration ||
+			l.expires.After(now) {
+			continue
+		}
+		l.expires = now.Add(m.options.leaseTimeout())
+		return l.plan, nil
+	}
+
+	dirs := make([]string, 0, len(m.t.parts[layer]))
+	for dir := range m.t.parts[layer] {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		var candidates []*IndexEntry
+		for _, e := range m.t.parts[layer][dir] {
+			if e.WriterID != writerId || pathIteration(e.Path) != iteration {
+				continue
+			}
+			if _, ok := m.t.leased[memKey{layer, e.Path}]; ok {
+				continue
+			}
+			if e.ChunkTime+conf.TimeoutSec()*1000000000 > now.UnixNano() {
+				continue
+			}
+			if !m.mergeBeforeMove(e, conf) {
+				continue
+			}
+			candidates = append(candidates, e)
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		slices.SortFunc(candidates, func(a, b *IndexEntry) int {
+			return cmp.Or(cmp.Compare(a.ChunkTime, b.ChunkTime), strings.Compare(a.Path, b.Path))
+		})
+		var from []string
+		var size int64
+		for _, e := range candidates {
+			if len(from) > 0 && size+e.SizeBytes > conf.MaxSize() {
+				break
+			}
+			from = append(from, e.Path)
+			size += e.SizeBytes
+		}
+		plan := MergePlan{
+			ID:        uuid.New().String(),
+			WriterID:  writerId,
+			Layer:     layer,
+			Database:  m.database,
+			Table:     m.table,
+			From:      from,
+			To:        path.Join(dir, fmt.Sprintf("%s.%d.parquet", uuid.New().String(), iteration+1)),
+			Iteration: iteration,
+		}
+		for _, f := range from {
+			m.t.leased[memKey{layer, f}] = plan.ID
+		}
+		m.t.merges[plan.ID] = &memLease[MergePlan]{plan: plan, expires: now.Add(m.options.leaseTimeout())}
+		return plan, nil
+	}
+	return MergePlan{}, nil
+}
+
+// mergeBeforeMove tells if the file is due to be merged rather than moved
+// to the next layer, the same way patch_index.lua decides it.
+func (m *memIndex) mergeBeforeMove(e *IndexEntry, conf MergeConfigurationsConf) bool {
+	i := m.getLayer(e.Layer)
+	if i < 0 || m.layers[i].TTLSec <= 0 {
+		return true
+	}
+	return conf.TimeoutSec() <= int64(m.layers[i].TTLSec)
+}
+
+func (m *memIndex) EndMerge(plan MergePlan) Promise[int32] {
+	return m.EndMergeCtx(context.Background(), plan)
+}
+
+func (m *memIndex) EndMergeCtx(ctx context.Context, plan MergePlan) Promise[int32] {
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	m.endMerge(plan.ID)
+	return Fulfilled[int32](nil, 0)
+}
+
+// endMerge releases the files of the plan. Runs under m.t.m.
+func (m *memIndex) endMerge(id string) {
+	l, ok := m.t.merges[id]
+	if !ok {
+		return
+	}
+	for _, f := range l.plan.From {
+		if m.t.leased[memKey{l.plan.Layer, f}] == id {
+			delete(m.t.leased, memKey{l.plan.Layer, f})
+		}
+	}
+	delete(m.t.merges, id)
+}
+
+func (m *memIndex) CommitMerge(plan MergePlan, result *IndexEntry) Promise[int32] {
+	return m.CommitMergeCtx(context.Background(), plan, result)
+}
+
+func (m *memIndex) CommitMergeCtx(ctx context.Context, plan MergePlan, result *IndexEntry) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
+	if m.getLayer(result.Layer) < 0 {
+		return Fulfilled[int32](fmt.Errorf("layer \"%s\" not found", result.Layer), 0)
+	}
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	l, ok := m.t.merges[plan.ID]
+	if !ok {
+		return Fulfilled[int32](fmt.Errorf("merge plan %s is not in progress", plan.ID), 0)
+	}
+	rm := make([]*IndexEntry, len(l.plan.From))
+	for i, f := range l.plan.From {
+		rm[i] = &IndexEntry{Layer: l.plan.Layer, Database: m.database, Table: m.table, Path: f,
+			WriterID: l.plan.WriterID}
+	}
+	m.add([]*IndexEntry{result})
+	m.rm(rm)
+	m.endMerge(plan.ID)
+	return Fulfilled(nil, int32(0))
+}
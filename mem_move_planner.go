@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"path"
+	"strings"
+	"time"
+)
+
+func (m *memIndex) GetMovePlanner() TableMovePlanner {
+	return m
+}
+
+func (m *memIndex) GetMovePlan(writerId string, layer string) (MovePlan, error) {
+	return m.GetMovePlanCtx(context.Background(), writerId, layer)
+}
+
+func (m *memIndex) GetMovePlanCtx(ctx context.Context, writerId string, layer string) (MovePlan, error) {
+	if err := ctx.Err(); err != nil {
+		return MovePlan{}, err
+	}
+	i := m.getLayer(layer)
+	if i < 0 || m.layers[i].TTLSec <= 0 {
+		return MovePlan{}, nil
+	}
+	layerTo := ""
+	if i+1 < len(m.layers) {
+		layerTo = m.layers[i+1].Name
+	}
+	mergeConfigurations := m.mergeConfigurations(layer)
+	now := time.Now()
+
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+
+	for _, l := range m.t.moves {
+		if l.plan.WriterID != writerId || l.plan.LayerFrom != layer || l.expires.After(now) {
+			continue
+		}
+		l.expires = now.Add(m.options.leaseTimeout())
+		return l.plan, nil
+	}
+
+	var candidate *IndexEntry
+	for _, part := range m.t.parts[layer] {
+		for _, e := range part {
+			if e.WriterID != writerId {
+				continue
+			}
+			if _, ok := m.t.leased[memKey{layer, e.Path}]; ok {
+				continue
+			}
+			if e.ChunkTime+int64(m.layers[i].TTLSec)*1000000000 > now.UnixNano() {
+				continue
+			}
+			iteration := pathIteration(e.Path)
+			if iteration >= 1 && iteration <= len(mergeConfigurations) &&
+				m.mergeBeforeMove(e, mergeConfigurations[iteration-1]) {
+				continue
+			}
+			if candidate == nil || e.ChunkTime < candidate.ChunkTime ||
+				(e.ChunkTime == candidate.ChunkTime && strings.Compare(e.Path, candidate.Path) < 0) {
+				candidate = e
+			}
+		}
+	}
+	if candidate == nil {
+		return MovePlan{}, nil
+	}
+	plan := MovePlan{
+		ID:        uuid.New().String(),
+		WriterID:  writerId,
+		Database:  m.database,
+		Table:     m.table,
+		PathFrom:  candidate.Path,
+		LayerFrom: layer,
+		PathTo: path.Join(path.Dir(candidate.Path),
+			fmt.Sprintf("%s.%d.parquet", uuid.New().String(), pathIteration(candidate.Path))),
+		LayerTo: layerTo,
+	}
+	m.t.leased[memKey{layer, candidate.Path}] = plan.ID
+	m.t.moves[plan.ID] = &memLease[MovePlan]{plan: plan, expires: now.Add(m.options.leaseTimeout())}
+	return plan, nil
+}
+
+func (m *memIndex) EndMove(plan MovePlan) Promise[int32] {
+	return m.EndMoveCtx(context.Background(), plan)
+}
+
+func (m *memIndex) EndMoveCtx(ctx context.Context, plan MovePlan) Promise[int32] {
+	m.t.m.Lock()
+	defer m.t.m.Unlock()
+	l, ok := m.t.moves[plan.ID]
+	if !ok {
+		return Fulfilled[int32](nil, 0)
+	}
+	key := memKey{l.plan.LayerFrom, l.plan.PathFrom}
+	if m.t.leased[key] == plan.ID {
+		delete(m.t.leased, key)
+	}
+	delete(m.t.moves, plan.ID)
+	return Fulfilled[int32](nil, 0)
+}
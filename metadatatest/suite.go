@@ -0,0 +1,840 @@
+// Package metadatatest provides a conformance suite for metadata.TableIndex
+// implementations. It pins down the behaviour shared by the JSON, Redis and
+// in-memory backends so that custom backends can be validated the same way:
+//
+//	func TestMyIndex(t *testing.T) {
+//		metadatatest.RunTableIndexSuite(t, func(t *testing.T, database string, table string,
+//			layers []metadata.Layer, options metadata.IndexOptions) metadata.TableIndex {
+//			idx, err := NewMyIndex(database, table, layers, options)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return idx
+//		})
+//	}
+package metadatatest
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gigapi/metadata"
+	"github.com/google/uuid"
+)
+
+// Factory creates an empty table index. Every call gets its own table name and
+// a fresh copy of layers, the factory may rewrite Layer.URL to point to the
+// storage of the backend. The index is stopped by the suite.
+type Factory func(t *testing.T, database string, table string, layers []metadata.Layer,
+	options metadata.IndexOptions) metadata.TableIndex
+
+const database = "default"
+
+// day is the partition every test entry goes to unless stated otherwise.
+var day = time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+
+// RunTableIndexSuite runs the conformance tests against the indexes created by
+// factory.
+func RunTableIndexSuite(t *testing.T, factory Factory) {
+	t.Run("BatchGet", func(t *testing.T) { testBatchGet(t, factory) })
+	t.Run("BatchRemove", func(t *testing.T) { testBatchRemove(t, factory) })
+	t.Run("Query", func(t *testing.T) { testQuery(t, factory) })
+	t.Run("QueryAcrossDays", func(t *testing.T) { testQueryAcrossDays(t, factory) })
+	t.Run("QueryIter", func(t *testing.T) { testQueryIter(t, factory) })
+	t.Run("QueryFilter", func(t *testing.T) { testQueryFilter(t, factory) })
+	t.Run("QueryAttributes", func(t *testing.T) { testQueryAttributes(t, factory) })
+	t.Run("QueryPages", func(t *testing.T) { testQueryPages(t, factory) })
+	t.Run("PartitionScheme", func(t *testing.T) { testPartitionScheme(t, factory) })
+	t.Run("UnparsedPartition", func(t *testing.T) { testUnparsedPartition(t, factory) })
+	t.Run("GetAll", func(t *testing.T) { testGetAll(t, factory) })
+	t.Run("GetAllIter", func(t *testing.T) { testGetAllIter(t, factory) })
+	t.Run("Stats", func(t *testing.T) { testStats(t, factory) })
+	t.Run("MergePlan", func(t *testing.T) { testMergePlan(t, factory) })
+	t.Run("MergePlanWriter", func(t *testing.T) { testMergePlanWriter(t, factory) })
+	t.Run("MergeBeforeMove", func(t *testing.T) { testMergeBeforeMove(t, factory) })
+	t.Run("MergeLease", func(t *testing.T) { testMergeLease(t, factory) })
+	t.Run("CommitMerge", func(t *testing.T) { testCommitMerge(t, factory) })
+	t.Run("MovePlan", func(t *testing.T) { testMovePlan(t, factory) })
+	t.Run("DropQueue", func(t *testing.T) { testDropQueue(t, factory) })
+	t.Run("DropDelay", func(t *testing.T) { testDropDelay(t, factory) })
+}
+
+// defaultLayers returns the layers of the suite: l1 moves its files to l2 after
+// a second, l2 keeps them.
+func defaultLayers(ttlSec int32) []metadata.Layer {
+	return []metadata.Layer{
+		{URL: "", Name: "l1", Type: "fs", TTLSec: ttlSec},
+		{URL: "", Name: "l2", Type: "fs"},
+	}
+}
+
+func defaultOptions() metadata.IndexOptions {
+	return metadata.IndexOptions{
+		MergeConfigurations: []metadata.MergeConfigurationsConf{
+			{0, 2500, 1},
+		},
+		// Below a second: the dropped files are handed out right away
+		DropDelay: time.Millisecond,
+	}
+}
+
+func newIndex(t *testing.T, factory Factory, layers []metadata.Layer,
+	options metadata.IndexOptions) (metadata.TableIndex, string) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	table := fmt.Sprintf("%s_%s", name, uuid.New().String()[:8])
+	idx := factory(t, database, table, slices.Clone(layers), options)
+	t.Cleanup(idx.Stop)
+	return idx, table
+}
+
+type entryOpts struct {
+	layer     string
+	writerId  string
+	hour      time.Time
+	iteration int
+	size      int64
+	// dir overrides the date=/hour= partition of hour
+	dir string
+}
+
+func newEntries(table string, n int, o entryOpts) []*metadata.IndexEntry {
+	if o.layer == "" {
+		o.layer = "l1"
+	}
+	if o.hour.IsZero() {
+		o.hour = day.Add(10 * time.Hour)
+	}
+	if o.iteration == 0 {
+		o.iteration = 1
+	}
+	if o.size == 0 {
+		o.size = 1000
+	}
+	if o.dir == "" {
+		o.dir = fmt.Sprintf("date=%s/hour=%02d", o.hour.Format("2006-01-02"), o.hour.Hour())
+	}
+	res := make([]*metadata.IndexEntry, n)
+	for i := range res {
+		minTime := o.hour.Add(time.Duration(i) * time.Minute)
+		res[i] = &metadata.IndexEntry{
+			Layer:     o.layer,
+			Database:  database,
+			Table:     table,
+			Path:      fmt.Sprintf("%s/%s.%d.parquet", o.dir, uuid.New().String(), o.iteration),
+			SizeBytes: o.size,
+			RowCount:  int64(i+1) * 10,
+			ChunkTime: time.Now().Add(-time.Hour).UnixNano(),
+			Min:       map[string]any{"value": float64(i)},
+			Max:       map[string]any{"value": float64(i + 10)},
+			MinTime:   minTime.UnixNano(),
+			MaxTime:   minTime.Add(time.Minute).UnixNano(),
+			WriterID:  o.writerId,
+		}
+	}
+	return res
+}
+
+func batch(t *testing.T, idx metadata.TableIndex, add []*metadata.IndexEntry, rm []*metadata.IndexEntry) {
+	t.Helper()
+	if _, err := idx.Batch(add, rm).Get(); err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+}
+
+func paths(entries []*metadata.IndexEntry) []string {
+	res := orderedPaths(entries)
+	slices.Sort(res)
+	return res
+}
+
+func orderedPaths(entries []*metadata.IndexEntry) []string {
+	res := make([]string, len(entries))
+	for i, e := range entries {
+		res[i] = e.Path
+	}
+	return res
+}
+
+func assertPaths(t *testing.T, got []*metadata.IndexEntry, want []*metadata.IndexEntry) {
+	t.Helper()
+	if !slices.Equal(paths(got), paths(want)) {
+		t.Fatalf("unexpected entries\ngot:  %v\nwant: %v", paths(got), paths(want))
+	}
+}
+
+func query(t *testing.T, idx metadata.TableIndex, options metadata.QueryOptions) []*metadata.IndexEntry {
+	t.Helper()
+	res, err := idx.GetQuerier().Query(options)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	return res
+}
+
+func testBatchGet(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := newEntries(table, 3, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+	for _, e := range ents {
+		got := idx.Get(e.Layer, e.Path)
+		if got == nil {
+			t.Fatalf("%s not found", e.Path)
+		}
+		if got.Path != e.Path || got.Layer != e.Layer || got.SizeBytes != e.SizeBytes ||
+			got.RowCount != e.RowCount || got.MinTime != e.MinTime || got.MaxTime != e.MaxTime ||
+			got.ChunkTime != e.ChunkTime || got.WriterID != e.WriterID {
+			t.Fatalf("unexpected entry\ngot:  %+v\nwant: %+v", got, e)
+		}
+		if fmt.Sprint(got.Min["value"]) != fmt.Sprint(e.Min["value"]) ||
+			fmt.Sprint(got.Max["value"]) != fmt.Sprint(e.Max["value"]) {
+			t.Fatalf("unexpected column statistics %v/%v", got.Min, got.Max)
+		}
+	}
+	if e := idx.Get("l1", "date=2024-01-15/hour=10/missing.1.parquet"); e != nil {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// A cancelled batch changes nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := newEntries(table, 1, entryOpts{writerId: "w1"})
+	if _, err := idx.BatchCtx(ctx, cancelled, nil).Get(); err == nil {
+		t.Fatal("expected an error for a cancelled context")
+	}
+	if e := idx.Get("l1", cancelled[0].Path); e != nil {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
+
+func testBatchRemove(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := newEntries(table, 2, entryOpts{})
+	batch(t, idx, ents, nil)
+	batch(t, idx, nil, ents[:1])
+	if e := idx.Get(ents[0].Layer, ents[0].Path); e != nil {
+		t.Fatalf("%s was not removed", e.Path)
+	}
+	if e := idx.Get(ents[1].Layer, ents[1].Path); e == nil {
+		t.Fatalf("%s was removed", ents[1].Path)
+	}
+}
+
+func testQuery(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	hour10 := newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour)})
+	hour12 := newEntries(table, 3, entryOpts{hour: day.Add(12 * time.Hour)})
+	merged := newEntries(table, 1, entryOpts{hour: day.Add(12 * time.Hour), iteration: 2})
+	all := slices.Concat(hour10, hour12, merged)
+	batch(t, idx, all, nil)
+
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day,
+		Before: day.Add(24 * time.Hour),
+	}), all)
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day.Add(12 * time.Hour),
+		Before: day.Add(13 * time.Hour),
+	}), slices.Concat(hour12, merged))
+	// Entries overlapping the bounds are returned
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day.Add(10*time.Hour + 90*time.Second),
+		Before: day.Add(10*time.Hour + 90*time.Second),
+	}), hour10[1:2])
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After: day.Add(11 * time.Hour),
+	}), slices.Concat(hour12, merged))
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		Folder: "date=2024-01-15/hour=10",
+	}), hour10)
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:     day,
+		Before:    day.Add(24 * time.Hour),
+		Iteration: 2,
+	}), merged)
+}
+
+func testQueryAcrossDays(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	before := newEntries(table, 2, entryOpts{hour: day.Add(-time.Hour)})
+	after := newEntries(table, 2, entryOpts{hour: day})
+	batch(t, idx, slices.Concat(before, after), nil)
+
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day.Add(-time.Hour),
+		Before: day.Add(time.Hour),
+	}), slices.Concat(before, after))
+}
+
+func testQueryIter(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	hour10 := newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour)})
+	hour12 := newEntries(table, 3, entryOpts{hour: day.Add(12 * time.Hour)})
+	batch(t, idx, slices.Concat(hour10, hour12), nil)
+
+	options := metadata.QueryOptions{After: day.Add(11 * time.Hour), Before: day.Add(24 * time.Hour)}
+	var res []*metadata.IndexEntry
+	for e, err := range idx.GetQuerier().QueryIter(context.Background(), options) {
+		if err != nil {
+			t.Fatalf("QueryIter failed: %v", err)
+		}
+		res = append(res, e)
+	}
+	assertPaths(t, res, hour12)
+
+	n := 0
+	for range idx.GetQuerier().QueryIter(context.Background(), metadata.QueryOptions{}) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected to stop after 2 entries, got %d", n)
+	}
+}
+
+func testQueryFilter(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	// The "value" column of the entry i spans [i, i+10]
+	ents := newEntries(table, 5, entryOpts{})
+	batch(t, idx, ents, nil)
+
+	for _, c := range []struct {
+		name   string
+		filter metadata.Predicate
+		want   []*metadata.IndexEntry
+	}{
+		{"Gt", metadata.Gt("value", 12), ents[3:]},
+		{"Lt", metadata.Lt("value", 1), ents[:1]},
+		{"Eq", metadata.Eq("value", 11.0), ents[1:]},
+		{"In", metadata.In("value", 0.5, 14), []*metadata.IndexEntry{ents[0], ents[4]}},
+		{"And", metadata.And(metadata.Ge("value", 12), metadata.Le("value", 2)), ents[2:3]},
+		{"Or", metadata.Or(metadata.Lt("value", 1), metadata.Gt("value", 13)),
+			[]*metadata.IndexEntry{ents[0], ents[4]}},
+		{"UnknownColumn", metadata.Eq("other", 1), ents},
+		{"OtherType", metadata.Eq("value", "1"), ents},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assertPaths(t, query(t, idx, metadata.QueryOptions{
+				After:  day,
+				Before: day.Add(24 * time.Hour),
+				Filter: c.filter,
+			}), c.want)
+		})
+	}
+}
+
+func testQueryAttributes(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	// Row counts are 10, 20 and 30
+	small := newEntries(table, 3, entryOpts{writerId: "w1", size: 100})
+	big := newEntries(table, 3, entryOpts{writerId: "w2", size: 5000})
+	cold := newEntries(table, 3, entryOpts{writerId: "w1", layer: "l2", size: 100})
+	batch(t, idx, slices.Concat(small, big, cold), nil)
+
+	for _, c := range []struct {
+		name    string
+		options metadata.QueryOptions
+		want    []*metadata.IndexEntry
+	}{
+		{"Layers", metadata.QueryOptions{Layers: []string{"l2"}}, cold},
+		{"WriterIDs", metadata.QueryOptions{WriterIDs: []string{"w2"}}, big},
+		{"Size", metadata.QueryOptions{MinSizeBytes: 100, MaxSizeBytes: 1000}, slices.Concat(small, cold)},
+		{"RowCount", metadata.QueryOptions{MinRowCount: 20, MaxRowCount: 20},
+			[]*metadata.IndexEntry{small[1], big[1], cold[1]}},
+		{"Combined", metadata.QueryOptions{Layers: []string{"l1"}, WriterIDs: []string{"w1", "w3"},
+			MaxSizeBytes: 1000, MinRowCount: 30}, small[2:]},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.options.After = day
+			c.options.Before = day.Add(24 * time.Hour)
+			assertPaths(t, query(t, idx, c.options), c.want)
+		})
+	}
+}
+
+func testQueryPages(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := slices.Concat(
+		newEntries(table, 3, entryOpts{hour: day.Add(12 * time.Hour), size: 300}),
+		newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour), size: 100}),
+		newEntries(table, 3, entryOpts{hour: day.Add(11 * time.Hour), size: 200}))
+	batch(t, idx, ents, nil)
+
+	readPages := func(options metadata.QueryOptions) []string {
+		t.Helper()
+		options.After = day
+		options.Before = day.Add(24 * time.Hour)
+		options.Limit = 2
+		var res []string
+		for i := 0; ; i++ {
+			page, cursor, err := metadata.QueryPage(context.Background(), idx.GetQuerier(), options)
+			if err != nil {
+				t.Fatalf("QueryPage failed: %v", err)
+			}
+			if len(page) > options.Limit {
+				t.Fatalf("page of %d entries with a limit of %d", len(page), options.Limit)
+			}
+			for _, e := range page {
+				res = append(res, e.Path)
+			}
+			if cursor == "" || i > len(ents) {
+				return res
+			}
+			options.Cursor = cursor
+		}
+	}
+
+	byTime := slices.Clone(ents)
+	slices.SortFunc(byTime, func(a, b *metadata.IndexEntry) int {
+		return cmp.Compare(a.MinTime, b.MinTime)
+	})
+	if got := readPages(metadata.QueryOptions{OrderBy: metadata.OrderByMinTime}); !slices.Equal(got, orderedPaths(byTime)) {
+		t.Fatalf("unexpected order by min time\ngot:  %v\nwant: %v", got, orderedPaths(byTime))
+	}
+
+	bySize := slices.Clone(ents)
+	slices.SortFunc(bySize, func(a, b *metadata.IndexEntry) int {
+		return cmp.Or(-cmp.Compare(a.SizeBytes, b.SizeBytes), -strings.Compare(a.Path, b.Path))
+	})
+	got := readPages(metadata.QueryOptions{OrderBy: metadata.OrderBySize, Descending: true})
+	if !slices.Equal(got, orderedPaths(bySize)) {
+		t.Fatalf("unexpected order by size\ngot:  %v\nwant: %v", got, orderedPaths(bySize))
+	}
+
+	if res := query(t, idx, metadata.QueryOptions{Limit: 4}); len(res) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(res))
+	}
+	_, err := idx.GetQuerier().Query(metadata.QueryOptions{OrderBy: metadata.OrderByPath, Cursor: "garbage"})
+	if err == nil {
+		t.Fatalf("expected an error for an invalid cursor")
+	}
+}
+
+func testPartitionScheme(t *testing.T, factory Factory) {
+	options := defaultOptions()
+	scheme := metadata.HiveScheme{Keys: []string{"tenant"}, Bucket: 15 * time.Minute}
+	options.PartitionScheme = scheme
+	idx, table := newIndex(t, factory, defaultLayers(0), options)
+	newBucket := func(tenant string, start time.Time) []*metadata.IndexEntry {
+		dir, err := scheme.Format(start, map[string]string{"tenant": tenant})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newEntries(table, 2, entryOpts{hour: start, dir: dir})
+	}
+	a1 := newBucket("a", day.Add(10*time.Hour))
+	a2 := newBucket("a", day.Add(10*time.Hour+15*time.Minute))
+	b1 := newBucket("b", day.Add(10*time.Hour))
+	batch(t, idx, slices.Concat(a1, a2, b1), nil)
+
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day,
+		Before: day.Add(24 * time.Hour),
+	}), slices.Concat(a1, a2, b1))
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day,
+		Before: day.Add(24 * time.Hour),
+		Keys:   map[string]string{"tenant": "a"},
+	}), slices.Concat(a1, a2))
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day.Add(10*time.Hour + 16*time.Minute),
+		Before: day.Add(10*time.Hour + 20*time.Minute),
+	}), a2)
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		Keys: map[string]string{"tenant": "b"},
+	}), b1)
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After: day.Add(10 * time.Hour),
+		Keys:  map[string]string{"tenant": "c"},
+	}), nil)
+	if e := idx.Get("l1", a2[0].Path); e == nil {
+		t.Fatalf("%s not found", a2[0].Path)
+	}
+}
+
+// testUnparsedPartition checks that a directory the scheme can not parse is
+// only left out of the queries filtering by time or keys.
+func testUnparsedPartition(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	hour10 := newEntries(table, 2, entryOpts{})
+	legacy := newEntries(table, 2, entryOpts{dir: "legacy/import"})
+	batch(t, idx, slices.Concat(hour10, legacy), nil)
+
+	assertPaths(t, query(t, idx, metadata.QueryOptions{}), slices.Concat(hour10, legacy))
+	assertPaths(t, query(t, idx, metadata.QueryOptions{Folder: "legacy"}), legacy)
+	assertPaths(t, query(t, idx, metadata.QueryOptions{Iteration: 1}), slices.Concat(hour10, legacy))
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		Keys: map[string]string{"tenant": "a"},
+	}), nil)
+}
+
+func testGetAll(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := slices.Concat(
+		newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour)}),
+		newEntries(table, 3, entryOpts{hour: day.Add(-10 * time.Hour)}),
+		newEntries(table, 2, entryOpts{layer: "l2"}))
+	batch(t, idx, ents, nil)
+	res, err := idx.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	assertPaths(t, res, ents)
+}
+
+func testGetAllIter(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := slices.Concat(
+		newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour)}),
+		newEntries(table, 3, entryOpts{hour: day.Add(-10 * time.Hour)}))
+	batch(t, idx, ents, nil)
+	var res []*metadata.IndexEntry
+	for e, err := range idx.GetAllIter(context.Background()) {
+		if err != nil {
+			t.Fatalf("GetAllIter failed: %v", err)
+		}
+		res = append(res, e)
+	}
+	assertPaths(t, res, ents)
+
+	n := 0
+	for range idx.GetAllIter(context.Background()) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected to stop after 2 entries, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, err := range idx.GetAllIter(ctx) {
+		if err == nil {
+			t.Fatalf("expected an error for a cancelled context")
+		}
+		break
+	}
+}
+
+func testStats(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	hour10 := newEntries(table, 3, entryOpts{hour: day.Add(10 * time.Hour)})
+	hour12 := newEntries(table, 2, entryOpts{hour: day.Add(12 * time.Hour), iteration: 2, size: 500})
+	cold := newEntries(table, 2, entryOpts{layer: "l2"})
+	batch(t, idx, slices.Concat(hour10, hour12, cold), nil)
+	batch(t, idx, nil, hour10[:1])
+	// Replacing an entry must not count it twice
+	batch(t, idx, hour12[:1], nil)
+
+	stats, err := idx.GetStats().Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if len(stats) != 2 || stats[0].Layer != "l1" || stats[1].Layer != "l2" {
+		t.Fatalf("expected the stats of l1 and l2, got %v", stats)
+	}
+	l1 := stats[0]
+	if l1.Files != 4 || l1.SizeBytes != 3000 || l1.RowCount != 20+30+10+20 {
+		t.Fatalf("unexpected l1 totals: %+v", l1.Stats)
+	}
+	if l1.MinTime != hour10[1].MinTime || l1.MaxTime != hour12[1].MaxTime {
+		t.Fatalf("unexpected l1 time bounds: %+v", l1.Stats)
+	}
+	want := map[int]metadata.IterationStats{
+		1: {Files: 2, SizeBytes: 2000, RowCount: 50},
+		2: {Files: 2, SizeBytes: 1000, RowCount: 30},
+	}
+	if !maps.Equal(l1.Iterations, want) {
+		t.Fatalf("unexpected l1 iterations: %v", l1.Iterations)
+	}
+	if len(l1.Partitions) != 2 ||
+		l1.Partitions[0].Path != "date=2024-01-15/hour=10" || l1.Partitions[0].Files != 2 ||
+		l1.Partitions[1].Path != "date=2024-01-15/hour=12" || l1.Partitions[1].Files != 2 {
+		t.Fatalf("unexpected l1 partitions: %v", l1.Partitions)
+	}
+	if stats[1].Files != 2 || len(stats[1].Partitions) != 1 {
+		t.Fatalf("unexpected l2 totals: %+v", stats[1].Stats)
+	}
+}
+
+func getMergePlan(t *testing.T, idx metadata.TableIndex, writerId string, layer string,
+	iteration int) metadata.MergePlan {
+	t.Helper()
+	plan, err := idx.GetMergePlanner().GetMergePlan(writerId, layer, iteration)
+	if err != nil {
+		t.Fatalf("GetMergePlan failed: %v", err)
+	}
+	return plan
+}
+
+func testMergePlan(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := newEntries(table, 4, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+
+	var plans []metadata.MergePlan
+	var from []string
+	for {
+		plan := getMergePlan(t, idx, "w1", "l1", 1)
+		if len(plan.From) == 0 {
+			break
+		}
+		if len(plans) == len(ents) {
+			t.Fatalf("the same files are planned more than once: %v", from)
+		}
+		plans = append(plans, plan)
+		from = append(from, plan.From...)
+	}
+	slices.Sort(from)
+	if !slices.Equal(from, paths(ents)) {
+		t.Fatalf("unexpected planned files\ngot:  %v\nwant: %v", from, paths(ents))
+	}
+	for _, plan := range plans {
+		if plan.ID == "" {
+			t.Fatalf("plan without an id: %+v", plan)
+		}
+		if plan.Layer != "l1" || plan.Iteration != 1 || plan.WriterID != "w1" ||
+			plan.Database != database || plan.Table != table {
+			t.Fatalf("unexpected plan %+v", plan)
+		}
+		// 2500 bytes per plan: 2 files of 1000 bytes
+		if len(plan.From) != 2 {
+			t.Fatalf("expected 2 files per plan, got %v", plan.From)
+		}
+		if path.Dir(plan.To) != path.Dir(plan.From[0]) || !strings.HasSuffix(plan.To, ".2.parquet") {
+			t.Fatalf("unexpected merge destination %s", plan.To)
+		}
+		if _, err := idx.GetMergePlanner().EndMerge(plan).Get(); err != nil {
+			t.Fatalf("EndMerge failed: %v", err)
+		}
+	}
+}
+
+func testMergePlanWriter(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	w1 := newEntries(table, 2, entryOpts{writerId: "w1"})
+	w2 := newEntries(table, 2, entryOpts{writerId: "w2"})
+	batch(t, idx, slices.Concat(w1, w2), nil)
+
+	if plan := getMergePlan(t, idx, "w3", "l1", 1); len(plan.From) != 0 {
+		t.Fatalf("unexpected plan for w3: %v", plan.From)
+	}
+	plan := getMergePlan(t, idx, "w2", "l1", 1)
+	slices.Sort(plan.From)
+	if !slices.Equal(plan.From, paths(w2)) {
+		t.Fatalf("unexpected plan for w2\ngot:  %v\nwant: %v", plan.From, paths(w2))
+	}
+}
+
+func testMergeBeforeMove(t *testing.T, factory Factory) {
+	// The files leave l1 after a second, before the 2 seconds of their merge
+	options := defaultOptions()
+	options.MergeConfigurations = []metadata.MergeConfigurationsConf{{2, 2500, 1}}
+	idx, table := newIndex(t, factory, defaultLayers(1), options)
+	ents := newEntries(table, 2, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+
+	if plan := getMergePlan(t, idx, "w1", "l1", 1); len(plan.From) != 0 {
+		t.Fatalf("the files to move are planned for a merge: %v", plan.From)
+	}
+	plan, err := idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetMovePlan failed: %v", err)
+	}
+	if !slices.Contains(paths(ents), plan.PathFrom) {
+		t.Fatalf("unexpected move plan %+v", plan)
+	}
+}
+
+func testMergeLease(t *testing.T, factory Factory) {
+	options := defaultOptions()
+	options.LeaseTimeout = time.Millisecond
+	idx, table := newIndex(t, factory, defaultLayers(0), options)
+	ents := newEntries(table, 2, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+
+	plan := getMergePlan(t, idx, "w1", "l1", 1)
+	if len(plan.From) == 0 {
+		t.Fatal("no merge plan")
+	}
+	time.Sleep(10 * time.Millisecond)
+	// The compactor never ended the plan: it is handed out again
+	again := getMergePlan(t, idx, "w1", "l1", 1)
+	if again.ID != plan.ID || !slices.Equal(again.From, plan.From) {
+		t.Fatalf("expired plan not handed out again\ngot:  %+v\nwant: %+v", again, plan)
+	}
+	batch(t, idx, nil, ents)
+	if _, err := idx.GetMergePlanner().EndMerge(again).Get(); err != nil {
+		t.Fatalf("EndMerge failed: %v", err)
+	}
+	if plan := getMergePlan(t, idx, "w1", "l1", 1); len(plan.From) != 0 {
+		t.Fatalf("ended plan handed out again: %+v", plan)
+	}
+}
+
+func testCommitMerge(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := newEntries(table, 2, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+
+	plan := getMergePlan(t, idx, "w1", "l1", 1)
+	if len(plan.From) != 2 {
+		t.Fatalf("unexpected merge plan %+v", plan)
+	}
+	result := *ents[0]
+	result.Path = plan.To
+	result.SizeBytes = 2000
+	result.MaxTime = ents[1].MaxTime
+	// The files merged are the ones of the plan handed out, not of the copy
+	// committed
+	stale := plan
+	stale.From = nil
+	if _, err := idx.GetMergePlanner().CommitMerge(stale, &result).Get(); err != nil {
+		t.Fatalf("CommitMerge failed: %v", err)
+	}
+	// The merged files are replaced by the result
+	assertPaths(t, query(t, idx, metadata.QueryOptions{
+		After:  day,
+		Before: day.Add(24 * time.Hour),
+	}), []*metadata.IndexEntry{&result})
+	res, err := idx.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	assertPaths(t, res, []*metadata.IndexEntry{&result})
+	// and queued for dropping
+	var dropped []string
+	for range ents {
+		drop, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+		if err != nil {
+			t.Fatalf("GetDropQueue failed: %v", err)
+		}
+		dropped = append(dropped, drop.Path)
+	}
+	slices.Sort(dropped)
+	if !slices.Equal(dropped, paths(ents)) {
+		t.Fatalf("unexpected drop queue\ngot:  %v\nwant: %v", dropped, paths(ents))
+	}
+	// The plan is over
+	if plan := getMergePlan(t, idx, "w1", "l1", 1); len(plan.From) != 0 {
+		t.Fatalf("committed plan handed out again: %+v", plan)
+	}
+	again := result
+	again.Path = strings.Replace(result.Path, ".2.parquet", ".3.parquet", 1)
+	if _, err = idx.GetMergePlanner().CommitMerge(plan, &again).Get(); err == nil {
+		t.Fatal("a plan is committed twice")
+	}
+	res, err = idx.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	assertPaths(t, res, []*metadata.IndexEntry{&result})
+}
+
+func testMovePlan(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(1), defaultOptions())
+	// The last merge iteration is 1: the merged files are only moved
+	ents := newEntries(table, 1, entryOpts{writerId: "w1", iteration: 2})
+	batch(t, idx, ents, nil)
+
+	plan, err := idx.GetMovePlanner().GetMovePlan("w2", "l1")
+	if err != nil {
+		t.Fatalf("GetMovePlan failed: %v", err)
+	}
+	if plan.PathFrom != "" {
+		t.Fatalf("unexpected move plan for w2: %+v", plan)
+	}
+	plan, err = idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetMovePlan failed: %v", err)
+	}
+	if plan.PathFrom != ents[0].Path || plan.LayerFrom != "l1" || plan.LayerTo != "l2" ||
+		plan.Database != database || plan.Table != table {
+		t.Fatalf("unexpected move plan %+v", plan)
+	}
+	if path.Dir(plan.PathTo) != path.Dir(plan.PathFrom) {
+		t.Fatalf("unexpected move destination %s", plan.PathTo)
+	}
+	// The file is leased until EndMove or the lease timeout
+	leased, err := idx.GetMovePlanner().GetMovePlan("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetMovePlan failed: %v", err)
+	}
+	if leased.PathFrom != "" {
+		t.Fatalf("%s is planned twice", leased.PathFrom)
+	}
+	if _, err = idx.GetMovePlanner().EndMove(plan).Get(); err != nil {
+		t.Fatalf("EndMove failed: %v", err)
+	}
+}
+
+func testDropQueue(t *testing.T, factory Factory) {
+	idx, table := newIndex(t, factory, defaultLayers(0), defaultOptions())
+	ents := newEntries(table, 1, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+	batch(t, idx, nil, ents)
+
+	for _, wl := range [][2]string{{"w2", "l1"}, {"w1", "l2"}} {
+		plan, err := idx.GetDropPlanner().GetDropQueue(wl[0], wl[1])
+		if err != nil {
+			t.Fatalf("GetDropQueue failed: %v", err)
+		}
+		if plan.Path != "" {
+			t.Fatalf("unexpected drop plan for %s in %s: %+v", wl[0], wl[1], plan)
+		}
+	}
+	plan, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetDropQueue failed: %v", err)
+	}
+	if plan.Path != ents[0].Path || plan.Layer != "l1" || plan.WriterID != "w1" {
+		t.Fatalf("unexpected drop plan %+v", plan)
+	}
+	// The plan is leased until RmFromDropQueue or the lease timeout
+	leased, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetDropQueue failed: %v", err)
+	}
+	if leased.Path != "" {
+		t.Fatalf("%s is handed out twice", leased.Path)
+	}
+	if _, err = idx.GetDropPlanner().RmFromDropQueue(plan).Get(); err != nil {
+		t.Fatalf("RmFromDropQueue failed: %v", err)
+	}
+	plan, err = idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetDropQueue failed: %v", err)
+	}
+	if plan.Path != "" {
+		t.Fatalf("%s is still in the drop queue", plan.Path)
+	}
+}
+
+func testDropDelay(t *testing.T, factory Factory) {
+	options := defaultOptions()
+	options.DropDelay = time.Hour
+	idx, table := newIndex(t, factory, defaultLayers(0), options)
+	ents := newEntries(table, 1, entryOpts{writerId: "w1"})
+	batch(t, idx, ents, nil)
+	batch(t, idx, nil, ents)
+
+	// Readers may still use the file
+	plan, err := idx.GetDropPlanner().GetDropQueue("w1", "l1")
+	if err != nil {
+		t.Fatalf("GetDropQueue failed: %v", err)
+	}
+	if plan.Path != "" {
+		t.Fatalf("%s is handed out before the drop delay", plan.Path)
+	}
+}
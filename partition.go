@@ -0,0 +1,185 @@
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PartitionScheme is the layout of the partition directories of a table. The
+// backends use it to find the partitions of a query, the writers to place
+// their files.
+type PartitionScheme interface {
+	// Format returns the partition directory of the files of time t. It
+	// fails if a key of the scheme has no value.
+	Format(t time.Time, keys map[string]string) (string, error)
+	// Parse reads the start of the time bucket and the keys of a partition
+	// directory.
+	Parse(dir string) (time.Time, map[string]string, error)
+	// Depth is the number of path segments of a partition directory
+	Depth() int
+	// Span is the length of a time bucket
+	Span() time.Duration
+}
+
+// HiveScheme lays the partitions out as key=value directories: the Keys in
+// order, then date=YYYY-MM-DD and, below a day, hour=HH and, below an hour,
+// minute=MM. E.g. tenant=acme/date=2024-01-15/hour=14/minute=30.
+type HiveScheme struct {
+	Keys []string
+	// Bucket is the time span of a partition: a day, an hour (the default)
+	// or a divisor of an hour such as 10 or 15 minutes
+	Bucket time.Duration
+}
+
+// DefaultPartitionScheme is the date=YYYY-MM-DD/hour=HH layout.
+var DefaultPartitionScheme PartitionScheme = HiveScheme{Bucket: time.Hour}
+
+func (h HiveScheme) Span() time.Duration {
+	if h.Bucket <= 0 {
+		return time.Hour
+	}
+	return h.Bucket
+}
+
+func (h HiveScheme) Depth() int {
+	res := len(h.Keys) + 1
+	if h.Span() < 24*time.Hour {
+		res++
+	}
+	if h.Span() < time.Hour {
+		res++
+	}
+	return res
+}
+
+func (h HiveScheme) Format(t time.Time, keys map[string]string) (string, error) {
+	var segs []string
+	for _, k := range h.Keys {
+		if keys[k] == "" {
+			return "", fmt.Errorf("partition key \"%s\" has no value", k)
+		}
+		segs = append(segs, k+"="+keys[k])
+	}
+	t = t.UTC().Truncate(h.Span())
+	segs = append(segs, "date="+t.Format("2006-01-02"))
+	if h.Span() < 24*time.Hour {
+		segs = append(segs, fmt.Sprintf("hour=%02d", t.Hour()))
+	}
+	if h.Span() < time.Hour {
+		segs = append(segs, fmt.Sprintf("minute=%02d", t.Minute()))
+	}
+	return strings.Join(segs, "/"), nil
+}
+
+func (h HiveScheme) Parse(dir string) (time.Time, map[string]string, error) {
+	segs := strings.Split(strings.Trim(dir, "/"), "/")
+	if len(segs) != h.Depth() {
+		return time.Time{}, nil, fmt.Errorf("\"%s\" is not a partition directory", dir)
+	}
+	value := func(i int, k string) (string, error) {
+		v, ok := strings.CutPrefix(segs[i], k+"=")
+		if !ok {
+			return "", fmt.Errorf("\"%s\": expected %s= instead of \"%s\"", dir, k, segs[i])
+		}
+		return v, nil
+	}
+	number := func(i int, k string, max int) (time.Duration, error) {
+		v, err := value(i, k)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n >= max {
+			return 0, fmt.Errorf("\"%s\": invalid %s \"%s\"", dir, k, v)
+		}
+		return time.Duration(n), nil
+	}
+	keys := make(map[string]string, len(h.Keys))
+	for i, k := range h.Keys {
+		v, err := value(i, k)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		keys[k] = v
+	}
+	i := len(h.Keys)
+	date, err := value(i, "date")
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if h.Span() < 24*time.Hour {
+		i++
+		hour, err := number(i, "hour", 24)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		t = t.Add(hour * time.Hour)
+	}
+	if h.Span() < time.Hour {
+		i++
+		minute, err := number(i, "minute", 60)
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		t = t.Add(minute * time.Minute)
+	}
+	return t, keys, nil
+}
+
+// matchPartition tells if the partition directory may hold files of the time
+// range and of the keys of the query. The scheme only parses the directory of
+// a query with any of them.
+func (o *QueryOptions) matchPartition(scheme PartitionScheme, dir string) bool {
+	if len(o.Keys) == 0 && o.Before.Unix() <= 0 && o.After.Unix() <= 0 {
+		return true
+	}
+	start, keys, err := scheme.Parse(dir)
+	if err != nil || !o.matchKeys(keys) {
+		return false
+	}
+	if o.Before.Unix() > 0 && start.After(o.Before) {
+		return false
+	}
+	if o.After.Unix() > 0 && !start.Add(scheme.Span()).After(o.After) {
+		return false
+	}
+	return true
+}
+
+func (o *QueryOptions) matchKeys(keys map[string]string) bool {
+	for k, v := range o.Keys {
+		if keys[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSegment prunes a directory above the partitions: a key of the query
+// with another value or a date out of the time range.
+func (o *QueryOptions) matchSegment(seg string) bool {
+	k, v, ok := strings.Cut(seg, "=")
+	if !ok {
+		return true
+	}
+	if want, ok := o.Keys[k]; ok {
+		return v == want
+	}
+	if k != "date" {
+		return true
+	}
+	day, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return true
+	}
+	if o.Before.Unix() > 0 && day.After(o.Before) {
+		return false
+	}
+	return o.After.Unix() <= 0 || day.Add(24*time.Hour).After(o.After)
+}
@@ -0,0 +1,228 @@
+package metadata
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+// Predicate is a condition on the columns of a file evaluated against the
+// IndexEntry Min and Max statistics. A file is pruned only if its statistics
+// prove that none of its rows can match: a column without statistics or a
+// value of a different type never prunes.
+type Predicate interface {
+	mayMatch(min map[string]any, max map[string]any) bool
+}
+
+type cmpOp int
+
+const (
+	opEq cmpOp = iota
+	opLt
+	opLe
+	opGt
+	opGe
+)
+
+type cmpPredicate struct {
+	column string
+	op     cmpOp
+	value  any
+}
+
+// Eq matches the files where the column can be equal to the value
+func Eq(column string, value any) Predicate {
+	return &cmpPredicate{column: column, op: opEq, value: value}
+}
+
+// Lt matches the files where the column can be less than the value
+func Lt(column string, value any) Predicate {
+	return &cmpPredicate{column: column, op: opLt, value: value}
+}
+
+// Le matches the files where the column can be less than or equal to the value
+func Le(column string, value any) Predicate {
+	return &cmpPredicate{column: column, op: opLe, value: value}
+}
+
+// Gt matches the files where the column can be greater than the value
+func Gt(column string, value any) Predicate {
+	return &cmpPredicate{column: column, op: opGt, value: value}
+}
+
+// Ge matches the files where the column can be greater than or equal to the value
+func Ge(column string, value any) Predicate {
+	return &cmpPredicate{column: column, op: opGe, value: value}
+}
+
+func (p *cmpPredicate) mayMatch(min map[string]any, max map[string]any) bool {
+	// c(x) is the comparison of the value with the statistic x
+	c := func(stats map[string]any) (int, bool) {
+		v, ok := stats[p.column]
+		if !ok {
+			return 0, false
+		}
+		return compareValues(p.value, v)
+	}
+	switch p.op {
+	case opEq:
+		cMin, okMin := c(min)
+		cMax, okMax := c(max)
+		return (!okMin || cMin >= 0) && (!okMax || cMax <= 0)
+	case opLt:
+		cMin, ok := c(min)
+		return !ok || cMin > 0
+	case opLe:
+		cMin, ok := c(min)
+		return !ok || cMin >= 0
+	case opGt:
+		cMax, ok := c(max)
+		return !ok || cMax < 0
+	case opGe:
+		cMax, ok := c(max)
+		return !ok || cMax <= 0
+	}
+	return true
+}
+
+type inPredicate struct {
+	column string
+	values []any
+}
+
+// In matches the files where the column can be equal to one of the values
+func In(column string, values ...any) Predicate {
+	return &inPredicate{column: column, values: values}
+}
+
+func (p *inPredicate) mayMatch(min map[string]any, max map[string]any) bool {
+	for _, v := range p.values {
+		if Eq(p.column, v).mayMatch(min, max) {
+			return true
+		}
+	}
+	return false
+}
+
+type andPredicate []Predicate
+
+// And matches the files that can match all the predicates
+func And(predicates ...Predicate) Predicate {
+	return andPredicate(predicates)
+}
+
+func (p andPredicate) mayMatch(min map[string]any, max map[string]any) bool {
+	for _, _p := range p {
+		if !_p.mayMatch(min, max) {
+			return false
+		}
+	}
+	return true
+}
+
+type orPredicate []Predicate
+
+// Or matches the files that can match at least one of the predicates
+func Or(predicates ...Predicate) Predicate {
+	return orPredicate(predicates)
+}
+
+func (p orPredicate) mayMatch(min map[string]any, max map[string]any) bool {
+	for _, _p := range p {
+		if _p.mayMatch(min, max) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two statistic values. Integers are compared exactly,
+// mixed integers and floats as floats. The second result is false if the
+// values cannot be compared.
+func compareValues(a any, b any) (int, bool) {
+	switch _a := a.(type) {
+	case string:
+		_b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(_a, _b), true
+	case bool:
+		_b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case _a == _b:
+			return 0, true
+		case _b:
+			return -1, true
+		}
+		return 1, true
+	}
+	a, okA := toNumber(a)
+	b, okB := toNumber(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	ia, intA := a.(int64)
+	ib, intB := b.(int64)
+	if intA && intB {
+		return cmp.Compare(ia, ib), true
+	}
+	fa, fb := toFloat(a), toFloat(b)
+	if math.IsNaN(fa) || math.IsNaN(fb) {
+		return 0, false
+	}
+	return cmp.Compare(fa, fb), true
+}
+
+// toNumber returns the value as an int64 or, if it is not an integer that
+// fits, as a float64.
+func toNumber(v any) (any, bool) {
+	switch _v := v.(type) {
+	case int:
+		return int64(_v), true
+	case int8:
+		return int64(_v), true
+	case int16:
+		return int64(_v), true
+	case int32:
+		return int64(_v), true
+	case int64:
+		return _v, true
+	case uint:
+		return toNumber(uint64(_v))
+	case uint8:
+		return int64(_v), true
+	case uint16:
+		return int64(_v), true
+	case uint32:
+		return int64(_v), true
+	case uint64:
+		if _v > math.MaxInt64 {
+			return float64(_v), true
+		}
+		return int64(_v), true
+	case float32:
+		return float64(_v), true
+	case float64:
+		return _v, true
+	case json.Number:
+		if i, err := _v.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := _v.Float64(); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(v any) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
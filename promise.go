@@ -1,6 +1,7 @@
 package metadata
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 )
@@ -96,3 +97,24 @@ func (p *WaitForAllPromise[T]) Done(res T, err error) {
 func (p *WaitForAllPromise[T]) Add(promise Promise[T]) {
 	p.promises = append(p.promises, promise)
 }
+
+// Await waits for the promise to be fulfilled or for ctx to be done,
+// whichever happens first. The operation behind the promise is not cancelled.
+func Await[T any](ctx context.Context, p Promise[T]) (T, error) {
+	type result struct {
+		res T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := p.Get()
+		done <- result{res, err}
+	}()
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-ctx.Done():
+		var res T
+		return res, ctx.Err()
+	}
+}
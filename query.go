@@ -0,0 +1,217 @@
+package metadata
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+)
+
+// match is the per-file check of the options shared by all the backends.
+// The backends may skip whole partitions before getting here.
+func (o *QueryOptions) match(e *IndexEntry) bool {
+	if o.Folder != "" && !strings.HasPrefix(e.Path, o.Folder) {
+		return false
+	}
+	if o.Iteration != 0 && pathIteration(e.Path) != o.Iteration {
+		return false
+	}
+	if o.Before.Unix() > 0 && e.MinTime > o.Before.UnixNano() {
+		return false
+	}
+	if o.After.Unix() > 0 && e.MaxTime < o.After.UnixNano() {
+		return false
+	}
+	if !o.hasLayer(e.Layer) {
+		return false
+	}
+	if len(o.WriterIDs) > 0 && !slices.Contains(o.WriterIDs, e.WriterID) {
+		return false
+	}
+	if (o.MinSizeBytes > 0 && e.SizeBytes < o.MinSizeBytes) ||
+		(o.MaxSizeBytes > 0 && e.SizeBytes > o.MaxSizeBytes) {
+		return false
+	}
+	if (o.MinRowCount > 0 && e.RowCount < o.MinRowCount) ||
+		(o.MaxRowCount > 0 && e.RowCount > o.MaxRowCount) {
+		return false
+	}
+	if o.Filter != nil && !o.Filter.mayMatch(e.Min, e.Max) {
+		return false
+	}
+	return true
+}
+
+// hasLayer lets the backends skip the layers out of the query.
+func (o *QueryOptions) hasLayer(layer string) bool {
+	return len(o.Layers) == 0 || slices.Contains(o.Layers, layer)
+}
+
+// OrderBy is the sort key of the query results.
+type OrderBy int
+
+const (
+	// OrderNone returns the entries in the order of the backend
+	OrderNone OrderBy = iota
+	OrderByMinTime
+	OrderByPath
+	OrderBySize
+)
+
+// queryCursor is the position after the last entry of a page. It carries the
+// order it was created for so it cannot be resumed with another one.
+type queryCursor struct {
+	OrderBy    OrderBy `json:"o"`
+	Descending bool    `json:"d,omitempty"`
+	Key        int64   `json:"k,omitempty"`
+	Layer      string  `json:"l"`
+	Path       string  `json:"p"`
+}
+
+// compare orders the entries by the sort key, then path and layer, so the
+// order is total and a cursor points to a single place.
+func (o *QueryOptions) compare(a *IndexEntry, b *IndexEntry) int {
+	var c int
+	switch o.OrderBy {
+	case OrderByMinTime:
+		c = cmp.Compare(a.MinTime, b.MinTime)
+	case OrderBySize:
+		c = cmp.Compare(a.SizeBytes, b.SizeBytes)
+	}
+	if c == 0 {
+		c = cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.Layer, b.Layer))
+	}
+	if o.Descending {
+		return -c
+	}
+	return c
+}
+
+func (o *QueryOptions) encodeCursor(e *IndexEntry) string {
+	c := queryCursor{OrderBy: o.OrderBy, Descending: o.Descending, Layer: e.Layer, Path: e.Path}
+	switch o.OrderBy {
+	case OrderByMinTime:
+		c.Key = e.MinTime
+	case OrderBySize:
+		c.Key = e.SizeBytes
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the last entry of the previous page, nil for the
+// first page.
+func (o *QueryOptions) decodeCursor() (*IndexEntry, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	var c queryCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if c.OrderBy != o.OrderBy || c.Descending != o.Descending || o.OrderBy == OrderNone {
+		return nil, fmt.Errorf("the cursor does not belong to the query order")
+	}
+	return &IndexEntry{Layer: c.Layer, Path: c.Path, MinTime: c.Key, SizeBytes: c.Key}, nil
+}
+
+// ordered applies OrderBy, Cursor and Limit to the raw result of a backend.
+// With a limit only the first Limit entries are kept in a heap.
+func (o *QueryOptions) ordered(seq iter.Seq2[*IndexEntry, error]) iter.Seq2[*IndexEntry, error] {
+	if o.OrderBy == OrderNone && o.Cursor == "" {
+		if o.Limit <= 0 {
+			return seq
+		}
+		return func(yield func(*IndexEntry, error) bool) {
+			n := 0
+			for e, err := range seq {
+				if !yield(e, err) || err != nil {
+					return
+				}
+				if n++; n >= o.Limit {
+					return
+				}
+			}
+		}
+	}
+	return func(yield func(*IndexEntry, error) bool) {
+		after, err := o.decodeCursor()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		h := &entryHeap{cmp: o.compare}
+		for e, err := range seq {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if after != nil && o.compare(e, after) <= 0 {
+				continue
+			}
+			if o.Limit <= 0 || h.Len() < o.Limit {
+				heap.Push(h, e)
+				continue
+			}
+			// The heap root is the greatest of the kept entries
+			if o.compare(e, h.entries[0]) < 0 {
+				h.entries[0] = e
+				heap.Fix(h, 0)
+			}
+		}
+		slices.SortFunc(h.entries, o.compare)
+		for _, e := range h.entries {
+			if !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
+
+// entryHeap keeps the greatest entry at the root.
+type entryHeap struct {
+	entries []*IndexEntry
+	cmp     func(a *IndexEntry, b *IndexEntry) int
+}
+
+func (h *entryHeap) Len() int           { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool { return h.cmp(h.entries[i], h.entries[j]) > 0 }
+func (h *entryHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *entryHeap) Push(x any)         { h.entries = append(h.entries, x.(*IndexEntry)) }
+func (h *entryHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// QueryPage runs an ordered query and returns a page of at most
+// options.Limit entries with the cursor of the next page. The cursor is empty
+// after the last page.
+func QueryPage(ctx context.Context, q TableQuerier, options QueryOptions) ([]*IndexEntry, string, error) {
+	if options.OrderBy == OrderNone {
+		return nil, "", fmt.Errorf("paging requires an order")
+	}
+	limit := options.Limit
+	if limit > 0 {
+		// One more entry tells whether there is a next page
+		options.Limit++
+	}
+	res, err := collectEntries(q.QueryIter(ctx, options))
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 || len(res) <= limit {
+		return res, "", nil
+	}
+	res = res[:limit]
+	return res, options.encodeCursor(res[limit-1]), nil
+}
@@ -30,9 +30,13 @@ func NewRedisDbIndex(URL string) (DBIndex, error) {
 }
 
 func (r *redisDbIndex) Databases() ([]string, error) {
+	return r.DatabasesCtx(context.Background())
+}
+
+func (r *redisDbIndex) DatabasesCtx(ctx context.Context) ([]string, error) {
 	databases := make(map[string]bool)
 	err := redisScan(func(cursor uint64) (uint64, error) {
-		keys, cursor, err := r.c.Scan(context.Background(), cursor, "folders:*", 1000).Result()
+		keys, cursor, err := r.c.Scan(ctx, cursor, "folders:*", 1000).Result()
 		if err != nil {
 			return 0, err
 		}
@@ -50,10 +54,14 @@ func (r *redisDbIndex) Databases() ([]string, error) {
 }
 
 func (r *redisDbIndex) Tables(database string) ([]string, error) {
+	return r.TablesCtx(context.Background(), database)
+}
+
+func (r *redisDbIndex) TablesCtx(ctx context.Context, database string) ([]string, error) {
 	tables := make(map[string]bool)
 	match := fmt.Sprintf("folders:%s:*", database)
 	err := redisScan(func(cursor uint64) (uint64, error) {
-		keys, cursor, err := r.c.Scan(context.Background(), cursor, match, 1000).Result()
+		keys, cursor, err := r.c.Scan(ctx, cursor, match, 1000).Result()
 		if err != nil {
 			return 0, err
 		}
@@ -71,10 +79,14 @@ func (r *redisDbIndex) Tables(database string) ([]string, error) {
 }
 
 func (r *redisDbIndex) Paths(database string, table string) ([]string, error) {
+	return r.PathsCtx(context.Background(), database, table)
+}
+
+func (r *redisDbIndex) PathsCtx(ctx context.Context, database string, table string) ([]string, error) {
 	var paths []string
 	key := fmt.Sprintf("folders:%s:%s", database, table)
 	err := redisScan(func(cursor uint64) (uint64, error) {
-		keys, cursor, err := r.c.HScan(context.Background(), key, cursor, "*", 1000).Result()
+		keys, cursor, err := r.c.HScan(ctx, key, cursor, "*", 1000).Result()
 		if err != nil {
 			return 0, err
 		}
@@ -1,10 +1,16 @@
 package metadata
 
+import "context"
+
 func (r *RedisIndex) GetDropPlanner() TableDropPlanner {
 	return r
 }
 
 func (r *RedisIndex) RmFromDropQueue(plan DropPlan) Promise[int32] {
+	return r.RmFromDropQueueCtx(context.Background(), plan)
+}
+
+func (r *RedisIndex) RmFromDropQueueCtx(ctx context.Context, plan DropPlan) Promise[int32] {
 	return Fulfilled((&redisTaskQueue[DropPlan]{
 		prefix:      "drop",
 		database:    r.database,
@@ -13,11 +19,16 @@ func (r *RedisIndex) RmFromDropQueue(plan DropPlan) Promise[int32] {
 		writerId:    plan.WriterID,
 		layer:       plan.Layer,
 		getEntrySHA: r.getMergePlanSha,
+		endEntrySHA: r.endMergeSha,
 		redis:       r.c,
-	}).finishProcess(plan), int32(0))
+	}).finishProcess(ctx, plan), int32(0))
 }
 
 func (r *RedisIndex) GetDropQueue(writerId string, layer string) (DropPlan, error) {
+	return r.GetDropQueueCtx(context.Background(), writerId, layer)
+}
+
+func (r *RedisIndex) GetDropQueueCtx(ctx context.Context, writerId string, layer string) (DropPlan, error) {
 	plan, err := (&redisTaskQueue[DropPlan]{
 		prefix:      "drop",
 		database:    r.database,
@@ -25,8 +36,9 @@ func (r *RedisIndex) GetDropQueue(writerId string, layer string) (DropPlan, erro
 		suffix:      "",
 		writerId:    writerId,
 		layer:       layer,
+		leaseSec:    r.options.leaseTimeoutSec(),
 		getEntrySHA: r.getMergePlanSha,
 		redis:       r.c,
-	}).processEntry()
+	}).processEntry(ctx)
 	return plan, err
 }
@@ -6,13 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/redis/go-redis/v9"
-	"math"
+	"iter"
 	"net"
 	"net/url"
-	"os"
+	"path"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type redisLayer struct {
@@ -64,11 +63,15 @@ type RedisIndex struct {
 	database string
 	table    string
 	layers   []redisLayer
+	options  IndexOptions
 }
 
 func getRedisClient(u *url.URL) (*redis.Client, error) {
 
 	strDb := strings.Trim(u.Path, "/")
+	if strDb == "" {
+		strDb = "0"
+	}
 	iDb, err := strconv.Atoi(strDb)
 	if err != nil {
 		return nil, fmt.Errorf("invalid Redis DB number: %s", strDb)
@@ -98,12 +101,17 @@ func getRedisClient(u *url.URL) (*redis.Client, error) {
 }
 
 func NewRedisIndex(URL string, database string, table string, layers []Layer) (TableIndex, error) {
+	return NewRedisIndexWithOptions(URL, database, table, layers, IndexOptions{})
+}
+
+func NewRedisIndexWithOptions(URL string, database string, table string, layers []Layer,
+	options IndexOptions) (TableIndex, error) {
 	u, err := url.Parse(URL)
 	if err != nil {
 		return nil, err
 	}
 
-	redisLayers := make([]redisLayer, len(layers))
+	redisLayers := make([]redisLayer, 0, len(layers))
 	for i, layer := range layers {
 		layerTo := ""
 		if i < len(layers)-1 {
@@ -120,6 +128,7 @@ func NewRedisIndex(URL string, database string, table string, layers []Layer) (T
 		database: database,
 		table:    table,
 		layers:   redisLayers,
+		options:  options,
 	}
 
 	client, err := getRedisClient(u)
@@ -140,6 +149,108 @@ func (r *RedisIndex) GetQuerier() TableQuerier {
 	return r
 }
 
+func (r *RedisIndex) GetStats() TableStats {
+	return r
+}
+
+func (r *RedisIndex) Stats() ([]*LayerStats, error) {
+	return r.StatsCtx(context.Background())
+}
+
+// StatsCtx reads the counters patch_index.lua keeps per partition: the
+// totals by merge iteration in the stats hash, under <layer>:<dir>:<iteration>
+// fields, and the time bounds in a sorted set per partition. No file is read.
+func (r *RedisIndex) StatsCtx(ctx context.Context) ([]*LayerStats, error) {
+	counters, err := r.c.HGetAll(ctx, fmt.Sprintf("stats:%s:%s", r.database, r.table)).Result()
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[[2]string]*PartitionStats)
+	for field, value := range counters {
+		layer, rest, _ := strings.Cut(field, ":")
+		rest, metric, _ := cutLast(rest, ":")
+		dir, it, _ := cutLast(rest, ":")
+		iteration, err := strconv.Atoi(it)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("stats %s: %w", field, err)
+		}
+		p := parts[[2]string{layer, dir}]
+		if p == nil {
+			p = &PartitionStats{Layer: layer, Path: dir, Stats: Stats{Iterations: make(map[int]IterationStats)}}
+			parts[[2]string{layer, dir}] = p
+		}
+		s := p.Iterations[iteration]
+		switch metric {
+		case "files":
+			s.Files = n
+			p.Files += n
+		case "size_bytes":
+			s.SizeBytes = n
+			p.SizeBytes += n
+		case "row_count":
+			s.RowCount = n
+			p.RowCount += n
+		}
+		p.Iterations[iteration] = s
+	}
+	pipe := r.c.Pipeline()
+	bounds := make(map[*PartitionStats][2]*redis.StringSliceCmd)
+	for k, p := range parts {
+		times := fmt.Sprintf("%s:%s:%s:%s", r.database, r.table, k[0], k[1])
+		bounds[p] = [2]*redis.StringSliceCmd{
+			pipe.ZRange(ctx, "stats_min:"+times, 0, 0),
+			pipe.ZRange(ctx, "stats_max:"+times, -1, -1),
+		}
+	}
+	if len(parts) > 0 {
+		if _, err = pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var res []*PartitionStats
+	for p, b := range bounds {
+		if p.MinTime, err = redisStatsTime(b[0].Val()); err != nil {
+			return nil, err
+		}
+		if p.MaxTime, err = redisStatsTime(b[1].Val()); err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	var layers []string
+	for _, l := range r.layers {
+		layers = append(layers, l.Name)
+	}
+	return layerStats(layers, res), nil
+}
+
+// redisStatsTime reads the time in front of the member of a stats_min or
+// stats_max set, written by time_key in patch_index.lua. It is 0 if the set
+// is empty.
+func redisStatsTime(members []string) (int64, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	t, _, _ := strings.Cut(members[0], ":")
+	if digits, ok := strings.CutPrefix(t, "-"); ok {
+		// 9's complement of the negative times
+		t = "-" + strings.Map(func(r rune) rune { return '9' - r + '0' }, digits)
+	}
+	return strconv.ParseInt(t, 10, 64)
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s string, sep string) (string, string, bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
 func (r *RedisIndex) initFuncs() error {
 	var err error
 	r.patchSha, err = r.c.ScriptLoad(context.Background(), string(SCRIPT_PATCH_INDEX)).Result()
@@ -155,10 +266,79 @@ func (r *RedisIndex) initFuncs() error {
 }
 
 func (r *RedisIndex) GetAll() ([]*IndexEntry, error) {
-	return nil, fmt.Errorf("not implemented")
+	return r.GetAllCtx(context.Background())
+}
+
+func (r *RedisIndex) GetAllCtx(ctx context.Context) ([]*IndexEntry, error) {
+	return collectEntries(r.GetAllIter(ctx))
+}
+
+// GetAllIter walks the day hashes with SCAN and every hash with HSCAN, so only
+// one page of entries is held in memory at a time.
+func (r *RedisIndex) GetAllIter(ctx context.Context) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		pattern := fmt.Sprintf("files:%s:%s:*", r.database, r.table)
+		// SCAN may return the same key more than once
+		seen := make(map[string]bool)
+		err := redisScan(func(cursor uint64) (uint64, error) {
+			keys, cursor, err := r.c.Scan(ctx, cursor, pattern, 1000).Result()
+			if err != nil {
+				return 0, err
+			}
+			for _, k := range keys {
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				err = r.scanEntries(ctx, k, yield)
+				if err != nil {
+					return 0, err
+				}
+			}
+			return cursor, nil
+		})
+		if err != nil && err != errStopIteration {
+			yield(nil, err)
+		}
+	}
+}
+
+var errStopIteration = fmt.Errorf("iteration stopped")
+
+func (r *RedisIndex) scanEntries(ctx context.Context, key string, yield func(*IndexEntry, error) bool) error {
+	return redisScan(func(cursor uint64) (uint64, error) {
+		kv, cursor, err := r.c.HScan(ctx, key, cursor, "", 1000).Result()
+		if err != nil {
+			return 0, err
+		}
+		for i := 1; i < len(kv); i += 2 {
+			var ie redisIndexEntry
+			if err := json.Unmarshal([]byte(kv[i]), &ie); err != nil {
+				return 0, fmt.Errorf("%s %s: %w", key, kv[i-1], err)
+			}
+			if !yield(ie.ToIndexEntry(), nil) {
+				return 0, errStopIteration
+			}
+		}
+		return cursor, nil
+	})
 }
 
 func (r *RedisIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return r.BatchCtx(context.Background(), add, rm)
+}
+
+func (r *RedisIndex) BatchCtx(ctx context.Context, add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
+	return r.patch(ctx, add, rm, map[string]any{})
+}
+
+// patch runs patch_index.lua over the entries. The options go with the drop
+// delay in keys[2]. The context is only checked before: once started the
+// script is not cancelled, the caller learns how it ended.
+func (r *RedisIndex) patch(ctx context.Context, add []*IndexEntry, rm []*IndexEntry, options map[string]any) Promise[int32] {
+	if err := ctx.Err(); err != nil {
+		return Fulfilled[int32](err, 0)
+	}
 	var cmds []any
 	for _, entry := range add {
 		cmd, err := json.Marshal(indexEntry2Redis(entry, "ADD"))
@@ -177,8 +357,13 @@ func (r *RedisIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
 	res := NewPromise[int32]()
 
 	var err error
-	var keys [2][]byte
-	keys[0], err = json.Marshal(MergeConfigurations)
+	var keys [3][]byte
+	// Per-layer overrides travel with the layers in keys[1]
+	mergeConfigurations := r.options.mergeConfigurations(nil)
+	if mergeConfigurations == nil {
+		mergeConfigurations = []MergeConfigurationsConf{}
+	}
+	keys[0], err = json.Marshal(mergeConfigurations)
 	if err != nil {
 		res.Done(0, err)
 		return res
@@ -192,11 +377,18 @@ func (r *RedisIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
 		res.Done(0, err)
 		return res
 	}
+	options["drop_delay_s"] = r.options.dropDelaySec()
+	keys[2], err = json.Marshal(options)
+	if err != nil {
+		res.Done(0, err)
+		return res
+	}
 
 	go func() {
-		_, err := r.c.EvalSha(context.Background(), r.patchSha, []string{
+		_, err := r.c.EvalSha(context.WithoutCancel(ctx), r.patchSha, []string{
 			string(keys[0]),
 			string(keys[1]),
+			string(keys[2]),
 		}, cmds...).Result()
 		res.Done(0, err)
 	}()
@@ -204,12 +396,11 @@ func (r *RedisIndex) Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32] {
 }
 
 func (r *RedisIndex) Get(layer string, path string) *IndexEntry {
-	firstFolder := strings.Split(path, "/")[0]
-	res, err := r.c.HGet(
-		context.Background(),
-		fmt.Sprintf("files:%s:%s:%s", r.database, r.table, firstFolder),
-		path,
-	).Result()
+	return r.GetCtx(context.Background(), layer, path)
+}
+
+func (r *RedisIndex) GetCtx(ctx context.Context, layer string, path string) *IndexEntry {
+	res, err := r.c.HGet(ctx, r.hashKey(path), path).Result()
 	if err != nil {
 		return nil
 	}
@@ -242,11 +433,27 @@ func redisScan(scanFn func(cursor uint64) (uint64, error)) error {
 	return nil
 }
 
-func (r *RedisIndex) getMainKeys(options QueryOptions) ([]string, error) {
-	if options.Folder != "" {
-		firstFolder := strings.SplitN(strings.TrimPrefix(options.Folder, "/"), string(os.PathSeparator), 2)[0]
-		mainKey := fmt.Sprintf("files:%s:%s:%s", r.database, r.table, firstFolder)
-		exist, err := r.c.Exists(context.Background(), mainKey).Result()
+// hashKey is the hash of the files of a path: the one of its day, the date
+// segment, or of its first segment if it has none. The other keys of the
+// partition scheme stay in the paths, the fields of the hash, so their
+// values do not multiply the hashes.
+func (r *RedisIndex) hashKey(path string) string {
+	segs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	seg := segs[0]
+	for _, s := range segs {
+		if strings.HasPrefix(s, "date=") {
+			seg = s
+			break
+		}
+	}
+	return fmt.Sprintf("files:%s:%s:%s", r.database, r.table, seg)
+}
+
+func (r *RedisIndex) getMainKeys(ctx context.Context, options QueryOptions) ([]string, error) {
+	if folder := strings.TrimPrefix(options.Folder, "/"); folder != "" &&
+		(strings.HasPrefix(folder, "date=") || strings.Contains(folder, "/date=")) {
+		mainKey := r.hashKey(folder)
+		exist, err := r.c.Exists(ctx, mainKey).Result()
 		if err != nil {
 			return nil, err
 		}
@@ -257,49 +464,21 @@ func (r *RedisIndex) getMainKeys(options QueryOptions) ([]string, error) {
 	}
 
 	if options.After.Unix() > 0 && options.Before.Unix() > 0 {
-		var keys []string
-		for start := options.After; start.Before(options.Before); start = start.Add(time.Hour * 24) {
-			mainKey := fmt.Sprintf("files:%s:%s:date=%s",
-				r.database, r.table, start.Format("2006-01-02"))
-			exist, err := r.c.Exists(context.Background(), mainKey).Result()
-			if err != nil {
-				return nil, err
-			}
-			if exist == 0 {
-				continue
-			}
-			keys = append(keys, mainKey)
+		keys, ok, err := r.getRangeMainKeys(ctx, options)
+		if ok || err != nil {
+			return keys, err
 		}
-		return keys, nil
 	}
 	pattern := fmt.Sprintf("files:%s:%s:*", r.database, r.table)
 	var allKeys []string
-	var dayAfter int64 = 0
-	if options.After.Unix() > 0 {
-		dayAfter = options.After.Truncate(24 * time.Hour).Unix()
-	}
-	var dayBefore int64 = math.MaxInt64
-	if options.Before.Unix() > 0 {
-		dayBefore = options.Before.Unix()
-	}
 	err := redisScan(func(cursor uint64) (uint64, error) {
-		keys, cursor, err := r.c.Scan(context.Background(), cursor, pattern, 10000).Result()
+		keys, cursor, err := r.c.Scan(ctx, cursor, pattern, 10000).Result()
 		if err != nil {
 			return 0, err
 		}
 		for _, k := range keys {
 			keyParts := strings.SplitN(k, ":", 4)
-			if len(keyParts) < 3 {
-				continue
-			}
-			date, err := time.Parse("2006-01-02", keyParts[3][5:])
-			if err != nil {
-				continue
-			}
-			if dayAfter > date.Unix() {
-				continue
-			}
-			if dayBefore < date.Unix() {
+			if len(keyParts) < 4 || !options.matchSegment(keyParts[3]) {
 				continue
 			}
 			allKeys = append(allKeys, k)
@@ -309,15 +488,37 @@ func (r *RedisIndex) getMainKeys(options QueryOptions) ([]string, error) {
 	return allKeys, err
 }
 
-func (r *RedisIndex) filterKeys(keys []string, day time.Time, options *QueryOptions) []string {
-	var hourAfter int64
-	if options.After.Unix() > 0 {
-		hourAfter = options.After.Truncate(time.Hour).Unix()
-	}
-	var hourBefore int64 = math.MaxInt64
-	if options.Before.Unix() > 0 {
-		hourBefore = options.Before.Unix()
+// getRangeMainKeys lists the hashes of the time buckets of the query, ok is
+// false if the partition directories depend on a key the query has no value
+// for.
+func (r *RedisIndex) getRangeMainKeys(ctx context.Context, options QueryOptions) ([]string, bool, error) {
+	scheme := r.options.partitionScheme()
+	var keys []string
+	seen := make(map[string]bool)
+	for start := options.After.UTC().Truncate(scheme.Span()); !start.After(options.Before); start = start.Add(scheme.Span()) {
+		dir, err := scheme.Format(start, options.Keys)
+		if err != nil {
+			return nil, false, nil
+		}
+		mainKey := r.hashKey(dir)
+		if seen[mainKey] {
+			continue
+		}
+		seen[mainKey] = true
+		exist, err := r.c.Exists(ctx, mainKey).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if exist == 0 {
+			continue
+		}
+		keys = append(keys, mainKey)
 	}
+	return keys, true, nil
+}
+
+func (r *RedisIndex) filterKeys(keys []string, options *QueryOptions) []string {
+	scheme := r.options.partitionScheme()
 	suffix := ""
 	if options.Iteration > 0 {
 		suffix = fmt.Sprintf(".%d.parquet", options.Iteration)
@@ -331,20 +532,7 @@ func (r *RedisIndex) filterKeys(keys []string, day time.Time, options *QueryOpti
 		if suffix != "" && !strings.HasSuffix(k, suffix) {
 			continue
 		}
-
-		parts := strings.SplitN(k, "/", 3)
-		if len(parts) < 3 {
-			continue
-		}
-		iHour, err := strconv.Atoi(parts[1][5:])
-		if err != nil {
-			continue
-		}
-		hour := day.Add(time.Duration(iHour) * time.Hour)
-		if hourAfter > hour.Unix() {
-			continue
-		}
-		if hourBefore < hour.Unix() {
+		if !options.matchPartition(scheme, path.Dir(k)) {
 			continue
 		}
 		res = append(res, k, keys[i+1])
@@ -352,62 +540,68 @@ func (r *RedisIndex) filterKeys(keys []string, day time.Time, options *QueryOpti
 	return res
 }
 
-func (r *RedisIndex) filterValues(values []string, options *QueryOptions) ([]*IndexEntry, error) {
+func (r *RedisIndex) filterValues(key string, values []string, options *QueryOptions) ([]*IndexEntry, error) {
 	var res []*IndexEntry
 	for i := 1; i < len(values); i += 2 {
-		strV := values[i]
 		var ie redisIndexEntry
-		err := json.Unmarshal([]byte(strV), &ie)
+		err := json.Unmarshal([]byte(values[i]), &ie)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("%s %s: %w", key, values[i-1], err)
 		}
-		ie.ToIndexEntry()
-		if options.Before.Unix() > 0 && ie.MinTime > options.Before.UnixNano() {
+		e := ie.ToIndexEntry()
+		if !options.match(e) {
 			continue
 		}
-		if options.After.Unix() > 0 && ie.MaxTime < options.After.UnixNano() {
-			continue
-		}
-		res = append(res, ie.ToIndexEntry())
+		res = append(res, e)
 	}
 	return res, nil
 }
 
 func (r *RedisIndex) Query(options QueryOptions) ([]*IndexEntry, error) {
-	keys := make(map[string][]string)
-	mainKeys, err := r.getMainKeys(options)
-	if err != nil {
-		return nil, err
-	}
-	for _, mainKey := range mainKeys {
-		parts := strings.SplitN(mainKey, ":", 4)
-		day, err := time.Parse("2006-01-02", parts[3][5:])
+	return r.QueryCtx(context.Background(), options)
+}
+
+func (r *RedisIndex) QueryCtx(ctx context.Context, options QueryOptions) ([]*IndexEntry, error) {
+	return collectEntries(r.QueryIter(ctx, options))
+}
+
+func (r *RedisIndex) QueryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return options.ordered(r.queryIter(ctx, options))
+}
+
+// queryIter yields the matching entries of every HSCAN page as soon as the
+// page is read.
+func (r *RedisIndex) queryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error] {
+	return func(yield func(*IndexEntry, error) bool) {
+		mainKeys, err := r.getMainKeys(ctx, options)
 		if err != nil {
-			continue
+			yield(nil, err)
+			return
 		}
-		_mainKey := mainKey
-		err = redisScan(func(cursor uint64) (uint64, error) {
-			_keys, cursor, err :=
-				r.c.HScan(context.Background(), _mainKey, cursor, "*", 10000).Result()
+		for _, mainKey := range mainKeys {
+			err := redisScan(func(cursor uint64) (uint64, error) {
+				kv, cursor, err := r.c.HScan(ctx, mainKey, cursor, "*", 10000).Result()
+				if err != nil {
+					return 0, err
+				}
+				entries, err := r.filterValues(mainKey, r.filterKeys(kv, &options), &options)
+				if err != nil {
+					return 0, err
+				}
+				for _, e := range entries {
+					if !yield(e, nil) {
+						return 0, errStopIteration
+					}
+				}
+				return cursor, nil
+			})
+			if err == errStopIteration {
+				return
+			}
 			if err != nil {
-				return 0, err
+				yield(nil, err)
+				return
 			}
-			_keys = r.filterKeys(_keys, day, &options)
-			keys[_mainKey] = append(keys[_mainKey], _keys...)
-			return cursor, nil
-		})
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	var res []*IndexEntry
-	for _, files := range keys {
-		ies, err := r.filterValues(files, &options)
-		if err != nil {
-			return nil, err
 		}
-		res = append(res, ies...)
 	}
-	return res, nil
 }
@@ -8,7 +8,7 @@ import (
 )
 
 var layers = []Layer{
-	{"file://./_testdata", "l1", "fs", 20},
+	{URL: "file://./_testdata", Name: "l1", Type: "fs", TTLSec: 20},
 }
 
 func TestSave(t *testing.T) {
@@ -29,7 +29,11 @@ func NewRedisKVStore(URL string) (KVStoreIndex, error) {
 }
 
 func (r *redisKVStoreIndex) Get(key string) ([]byte, error) {
-	val, err := r.c.Get(context.Background(), key).Result()
+	return r.GetCtx(context.Background(), key)
+}
+
+func (r *redisKVStoreIndex) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	val, err := r.c.Get(ctx, key).Result()
 	if err != nil {
 		return nil, nil
 	}
@@ -37,11 +41,19 @@ func (r *redisKVStoreIndex) Get(key string) ([]byte, error) {
 }
 
 func (r redisKVStoreIndex) Put(key string, value []byte) error {
-	return r.c.Set(context.Background(), key, value, 0).Err()
+	return r.PutCtx(context.Background(), key, value)
+}
+
+func (r redisKVStoreIndex) PutCtx(ctx context.Context, key string, value []byte) error {
+	return r.c.Set(ctx, key, value, 0).Err()
 }
 
 func (r redisKVStoreIndex) Delete(key string) error {
-	return r.c.Del(context.Background(), key).Err()
+	return r.DeleteCtx(context.Background(), key)
+}
+
+func (r redisKVStoreIndex) DeleteCtx(ctx context.Context, key string) error {
+	return r.c.Del(ctx, key).Err()
 }
 
 func (r redisKVStoreIndex) Destroy() {
@@ -21,10 +21,14 @@ func (r redisMergePlan) Id() string {
 }
 
 func (r *RedisIndex) GetMergePlan(writerId string, layer string, iteration int) (MergePlan, error) {
+	return r.GetMergePlanCtx(context.Background(), writerId, layer, iteration)
+}
+
+func (r *RedisIndex) GetMergePlanCtx(ctx context.Context, writerId string, layer string, iteration int) (MergePlan, error) {
 	mergePattern := fmt.Sprintf("merge:%s:%s:%d:*:%s:%s:*", r.database, r.table, iteration, layer, writerId)
 	var keys []string
 	err := redisScan(func(cursor uint64) (uint64, error) {
-		_keys, cursor, err := r.c.Scan(context.Background(), cursor, mergePattern, 1000).Result()
+		_keys, cursor, err := r.c.Scan(ctx, cursor, mergePattern, 1000).Result()
 		if err != nil {
 			return 0, err
 		}
@@ -49,9 +53,10 @@ func (r *RedisIndex) GetMergePlan(writerId string, layer string, iteration int)
 			suffix:      strconv.Itoa(iteration) + ":" + dir,
 			writerId:    writerId,
 			layer:       layer,
+			leaseSec:    r.options.leaseTimeoutSec(),
 			getEntrySHA: r.getMergePlanSha,
 			redis:       r.c,
-		}).processEntry()
+		}).processEntry(ctx)
 		if err != nil {
 			return MergePlan{}, err
 		}
@@ -80,6 +85,10 @@ func (r *RedisIndex) GetMergePlan(writerId string, layer string, iteration int)
 }
 
 func (r *RedisIndex) EndMerge(plan MergePlan) Promise[int32] {
+	return r.EndMergeCtx(context.Background(), plan)
+}
+
+func (r *RedisIndex) EndMergeCtx(ctx context.Context, plan MergePlan) Promise[int32] {
 	fmt.Println("removing merge plan from Redis: ", plan.ID)
 	dir := filepath.Dir(plan.To)
 	err := (&redisTaskQueue[redisMergePlan]{
@@ -90,12 +99,34 @@ func (r *RedisIndex) EndMerge(plan MergePlan) Promise[int32] {
 		writerId:    plan.WriterID,
 		layer:       plan.Layer,
 		getEntrySHA: r.getMergePlanSha,
+		endEntrySHA: r.endMergeSha,
 		redis:       r.c,
-	}).finishProcess(redisMergePlan{ID: plan.ID})
+	}).finishProcess(ctx, redisMergePlan{ID: plan.ID})
 	fmt.Println("removing merge plan from Redis ok")
 	return Fulfilled(err, int32(0))
 }
 
+func (r *RedisIndex) CommitMerge(plan MergePlan, result *IndexEntry) Promise[int32] {
+	return r.CommitMergeCtx(context.Background(), plan, result)
+}
+
+// CommitMergeCtx patches the index and removes the plan from processing in
+// the same patch_index.lua call. The merged files are the ones of the plan in
+// processing, found by its id, the From of the caller is not trusted.
+func (r *RedisIndex) CommitMergeCtx(ctx context.Context, plan MergePlan, result *IndexEntry) Promise[int32] {
+	return r.patch(ctx, []*IndexEntry{result}, nil, map[string]any{
+		"end_merge": map[string]string{
+			"key": fmt.Sprintf("merge:%s:%s:%d:%s:%s:%s:processing",
+				r.database, r.table, plan.Iteration, filepath.Dir(result.Path), plan.Layer, plan.WriterID),
+			"id":        plan.ID,
+			"database":  r.database,
+			"table":     r.table,
+			"layer":     plan.Layer,
+			"writer_id": plan.WriterID,
+		},
+	})
+}
+
 func (r *RedisIndex) GetMergePlanner() TableMergePlanner {
 	return r
 }
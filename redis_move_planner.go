@@ -1,10 +1,16 @@
 package metadata
 
+import "context"
+
 func (r *RedisIndex) GetMovePlanner() TableMovePlanner {
 	return r
 }
 
 func (r *RedisIndex) GetMovePlan(writerId string, layer string) (MovePlan, error) {
+	return r.GetMovePlanCtx(context.Background(), writerId, layer)
+}
+
+func (r *RedisIndex) GetMovePlanCtx(ctx context.Context, writerId string, layer string) (MovePlan, error) {
 	return (&redisTaskQueue[MovePlan]{
 		prefix:      "move",
 		database:    r.database,
@@ -12,12 +18,17 @@ func (r *RedisIndex) GetMovePlan(writerId string, layer string) (MovePlan, error
 		suffix:      "",
 		writerId:    writerId,
 		layer:       layer,
+		leaseSec:    r.options.leaseTimeoutSec(),
 		getEntrySHA: r.getMergePlanSha,
 		redis:       r.c,
-	}).processEntry()
+	}).processEntry(ctx)
 }
 
 func (r *RedisIndex) EndMove(plan MovePlan) Promise[int32] {
+	return r.EndMoveCtx(context.Background(), plan)
+}
+
+func (r *RedisIndex) EndMoveCtx(ctx context.Context, plan MovePlan) Promise[int32] {
 	return Fulfilled((&redisTaskQueue[MovePlan]{
 		prefix:      "move",
 		database:    r.database,
@@ -26,6 +37,7 @@ func (r *RedisIndex) EndMove(plan MovePlan) Promise[int32] {
 		writerId:    plan.WriterID,
 		layer:       plan.LayerFrom,
 		getEntrySHA: r.getMergePlanSha,
+		endEntrySHA: r.endMergeSha,
 		redis:       r.c,
-	}).finishProcess(plan), int32(0))
+	}).finishProcess(ctx, plan), int32(0))
 }
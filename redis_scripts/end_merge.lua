@@ -1,29 +1,30 @@
--- Get the parameters from KEYS
-local database = KEYS[1]
-local table = KEYS[2]
-local index = KEYS[3]
-local layer = KEYS[4]
-local writer_id = KEYS[5]
-local merge_id = KEYS[6]
+-- Construct the processing key the same way get_merge_plan.lua does
+local prefix = KEYS[1]
+local database = KEYS[2]
+local table = KEYS[3]
+local suffix = KEYS[4]
+local layer = KEYS[5]
+local writer_id = KEYS[6]
+local entry_id = ARGV[1]
 
--- Construct the merge key
-local merge_key = "merge:" .. database .. ":" .. table .. ":" .. index .. ":" .. layer .. ":" .. writer_id .. ":processing"
+if suffix ~= "" then
+    suffix = suffix .. ":"
+end
+local processing_key = prefix .. ":" .. database .. ":" .. table .. ":" .. suffix .. layer .. ":" .. writer_id .. ":processing"
 
--- Function to remove a merge plan by ID
-local function remove_merge_plan(key, id)
+-- Function to remove a handed out entry by ID, in one step so a concurrent
+-- lease renewal cannot rewrite it in between
+local function remove_entry(key, id)
     local items = redis.call("LRANGE", key, 0, -1)
     for i, item_json in ipairs(items) do
         local item = cjson.decode(item_json)
         if item.id == id then
             -- Remove the item from the list
             redis.call("LREM", key, 1, item_json)
-            return true
+            return 1
         end
     end
-    return false
+    return 0
 end
 
--- Try to remove the merge plan
-remove_merge_plan(merge_key, merge_id)
-
-return ""
\ No newline at end of file
+return remove_entry(processing_key, entry_id)
@@ -5,6 +5,8 @@ local table = KEYS[3]
 local suffix = KEYS[4]
 local layer = KEYS[5]
 local writer_id = KEYS[6]
+-- Lease of the handed out items: they are handed out again after it
+local lease_s = tonumber(ARGV[1]) or 1800
 
 if suffix ~= "" then
     suffix = suffix .. ":"
@@ -25,7 +27,7 @@ local function process_idle_item()
             redis.call("LPUSH", merge_key_idle, merge_item_json)
             return false
         end
-        merge_item.time_s = current_time + 1800 -- 30m timeout to reprocess the dead items
+        merge_item.time_s = current_time + lease_s -- timeout to reprocess the dead items
         local updated_item_json = cjson.encode(merge_item)
 
         -- Push the updated item to the processing list
@@ -45,7 +47,7 @@ local function process_processing_item()
             redis.call("LPUSH", merge_key_processing, merge_item_json)
             return false
         end
-        merge_item.time_s = current_time + 1800 -- 30m timeout to reprocess the dead items
+        merge_item.time_s = current_time + lease_s -- timeout to reprocess the dead items
         local updated_item_json = cjson.encode(merge_item)
 
         -- Push the updated item to the processing list
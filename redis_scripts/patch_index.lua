@@ -1,5 +1,10 @@
 local merge_conf = cjson.decode(KEYS[1])
 local move_conf = cjson.decode(KEYS[2])
+local options = {}
+if KEYS[3] then
+    options = cjson.decode(KEYS[3])
+end
+local drop_delay_s = tonumber(options.drop_delay_s or 30)
 
 math.randomseed(tonumber(redis.call('TIME')[1]) * 1000 +
         tonumber(redis.call('TIME')[2]) / 1000) -- Seed the random number generator with the current time
@@ -18,10 +23,19 @@ local function get_dir(path)
     return string.match(path, "(.+)/[^/]+$")
 end
 
+-- Function to get the merge configuration of a layer: the layer override or the table default
+local function get_merge_conf(layer)
+    local l = move_conf[layer]
+    if l and type(l.merge_configurations) == "table" and #l.merge_configurations > 0 then
+        return l.merge_configurations
+    end
+    return merge_conf
+end
+
 -- Function to create and push a new merge object
-local function create_and_push_new_merge(merge_key, path, size, index)
+local function create_and_push_new_merge(merge_key, path, size, index, conf)
 	local current_time = tonumber(redis.call("TIME")[1])
-    local merge_ttl_s = merge_conf[index][1]
+    local merge_ttl_s = conf[index][1]
     local new_merge = cjson.encode({
         id = generate_uuid(),
         time_s = current_time + merge_ttl_s,
@@ -32,11 +46,63 @@ local function create_and_push_new_merge(merge_key, path, size, index)
     return new_merge
 end
 
+-- Function to get the hash of a file: the one of its day, or of its first
+-- segment if it has no date segment. Keep in sync with RedisIndex.hashKey.
 local function hash_key(entry)
-    local main_key = string.match(entry.path, "([^/]+)/.*")
+    local main_key = string.match("/" .. entry.path, "/(date=[^/]+)/") or
+            string.match(entry.path, "([^/]+)/.*")
     return "files:" .. entry.database .. ":" .. entry.table .. ":" .. main_key
 end
 
+-- Function to make a time sort as a string: 20 digits, the negative ones
+-- first in 9's complement. Keep in sync with redisStatsTime.
+local function time_key(str_time)
+    str_time = str_time or "0"
+    if string.sub(str_time, 1, 1) ~= "-" then
+        return string.rep("0", 20 - #str_time) .. str_time
+    end
+    local digits = string.sub(str_time, 2)
+    digits = string.rep("0", 19 - #digits) .. digits
+    return "-" .. (string.gsub(digits, "%d", function(d) return tostring(9 - tonumber(d)) end))
+end
+
+-- Function to count a stored file in the stats of its partition (sign 1) or
+-- to take it out (sign -1): its totals by merge iteration, and its times in
+-- the sorted sets the bounds are read from. Keep in sync with
+-- RedisIndex.StatsCtx.
+local function count_file(entry, sign)
+    local dir = get_dir(entry.path)
+    local iteration = tostring(tonumber(string.match(entry.path, "%.(%d+)%.parquet$") or "0"))
+    local stats_key = "stats:" .. entry.database .. ":" .. entry.table
+    local field = entry.layer .. ":" .. dir .. ":" .. iteration .. ":"
+    local files = redis.call("HINCRBY", stats_key, field .. "files", sign)
+    if files <= 0 then
+        redis.call("HDEL", stats_key, field .. "files", field .. "size_bytes", field .. "row_count")
+    else
+        redis.call("HINCRBY", stats_key, field .. "size_bytes", sign * (entry.size_bytes or 0))
+        redis.call("HINCRBY", stats_key, field .. "row_count", sign * (entry.row_count or 0))
+    end
+    local times_key = entry.database .. ":" .. entry.table .. ":" .. entry.layer .. ":" .. dir
+    local min_member = time_key(entry.str_min_time) .. ":" .. entry.path
+    local max_member = time_key(entry.str_max_time) .. ":" .. entry.path
+    if sign > 0 then
+        redis.call("ZADD", "stats_min:" .. times_key, 0, min_member)
+        redis.call("ZADD", "stats_max:" .. times_key, 0, max_member)
+    else
+        redis.call("ZREM", "stats_min:" .. times_key, min_member)
+        redis.call("ZREM", "stats_max:" .. times_key, max_member)
+    end
+end
+
+-- Function to take the file stored under the path of the entry out of the
+-- stats, if there is one
+local function uncount_stored(main_key, entry)
+    local stored = redis.call("HGET", main_key, entry.path)
+    if stored then
+        count_file(cjson.decode(stored), -1)
+    end
+end
+
 local function delete_file(entry)
     -- Split the path into main key and hash field
     local main_key = hash_key(entry)
@@ -45,6 +111,7 @@ local function delete_file(entry)
         return {success = false, error = "Invalid file path format for deletion: " .. entry.path}
     end
 
+    uncount_stored(main_key, entry)
     redis.call("HDEL", main_key, entry.path)
     local dir = get_dir(entry.path)
     local files_cnt = redis.call("HINCRBY", "folders:" .. entry.database .. ":" .. entry.table, dir, -1)
@@ -66,30 +133,30 @@ local function delete_file(entry)
         path = entry.path,
         database = entry.database,
         table = entry.table,
-        time_s = tonumber(redis.call("TIME")[1]) + 30
+        time_s = tonumber(redis.call("TIME")[1]) + drop_delay_s
     })
     redis.call("RPUSH", drop_queue_key, new_drop)
 
     return {success = true}
 end
 
-local function merge_entry(entry, index)
+local function merge_entry(entry, index, conf)
     local dir = get_dir(entry.path)
     local merge_key = "merge:" .. entry.database .. ":" .. entry.table .. ":" .. index .. ":" .. dir .. ":" .. entry.layer .. ":" .. entry.writer_id .. ":idle"
     local last_merge = redis.call("LINDEX", merge_key, -1)
 
     if not last_merge then
         -- Create and push a new merge object
-        create_and_push_new_merge(merge_key, entry.path, entry.size_bytes, index)
+        create_and_push_new_merge(merge_key, entry.path, entry.size_bytes, index, conf)
         return {success = true}
     end
 
     -- Parse JSON from the last merge entry
     local last_merge_data = cjson.decode(last_merge)
 
-    if last_merge_data.size + entry.size_bytes > tonumber(merge_conf[index][2]) then
+    if last_merge_data.size + entry.size_bytes > tonumber(conf[index][2]) then
         -- Create and push a new merge object
-        create_and_push_new_merge(merge_key, entry.path, entry.size_bytes, index)
+        create_and_push_new_merge(merge_key, entry.path, entry.size_bytes, index, conf)
         return {success = true}
     end
 
@@ -146,21 +213,25 @@ local function process_file(entry)
 
     -- Create a Redis entry for the file
     local main_key = hash_key(entry)
+    uncount_stored(main_key, entry)
     redis.call("HSET", main_key, entry.path, cjson.encode(entry))
+    count_file(entry, 1)
 
+    local conf = get_merge_conf(entry.layer)
     local merge_ttl = -1
     local move_ttl = -1
-    if index_num <= #merge_conf then
-         merge_ttl = merge_conf[index_num][1]
+    if index_num <= #conf then
+         merge_ttl = conf[index_num][1]
     end
     if move_conf[entry.layer].ttl_sec > 0 then
         move_ttl = move_conf[entry.layer].ttl_sec
     end
 
     if merge_ttl ~= -1 and move_ttl == -1 then
-        return merge_entry(entry, index_num)
+        return merge_entry(entry, index_num, conf)
     end
     if move_ttl ~= -1 and merge_ttl == -1 then
+        entry.time_s = tonumber(entry.str_chunk_time) / 1000000000 + move_ttl
         return move_entry(entry)
     end
     if merge_ttl == -1 and move_ttl == -1 then
@@ -168,17 +239,72 @@ local function process_file(entry)
     end
 
     local chunk_time_s = tonumber(entry.str_chunk_time) / 1000000000
-    local merge_time_s = chunk_time_s + tonumber(merge_conf[index_num][1])
+    local merge_time_s = chunk_time_s + tonumber(conf[index_num][1])
     local move_time_s = chunk_time_s + move_conf[entry.layer].ttl_sec
 
     if move_conf[entry.layer].ttl_sec == 0 or merge_time_s <= move_time_s then
         entry.time_s = merge_time_s
-        return merge_entry(entry, index_num)
+        return merge_entry(entry, index_num, conf)
     end
     entry.time_s = move_time_s
     return move_entry(entry)
 end
 
+-- Function to find a merge plan in progress by ID
+local function find_merge(key, id)
+    local items = redis.call("LRANGE", key, 0, -1)
+    for _, item_json in ipairs(items) do
+        if cjson.decode(item_json).id == id then
+            return item_json
+        end
+    end
+    return nil
+end
+
+-- Check all files first: the script is not rolled back on error, a patch is
+-- applied whole or not at all
+for i = 1, #ARGV do
+    local entry = cjson.decode(ARGV[i])
+    if not string.match(entry.path, "([^/]+)/.*") then
+        return redis.error_reply("Error processing file: " .. entry.path .. " - Invalid file path format")
+    end
+    if entry.cmd ~= "DELETE" then
+        if not string.match(entry.path, "(.+)/[^/]+%.(%d+)%.parquet$") then
+            return redis.error_reply("Error processing file: " .. entry.path .. " - Invalid file path format")
+        end
+        if not move_conf[entry.layer] then
+            return redis.error_reply("Error processing file: " .. entry.path .. " - layer \"" ..
+                    entry.layer .. "\" not found")
+        end
+    end
+end
+
+-- A merge commit ends its plan with the patch and removes the files of the
+-- plan as stored, not as the caller has it
+local end_merge_item = nil
+local merged = {}
+if options.end_merge then
+    local end_merge = options.end_merge
+    end_merge_item = find_merge(end_merge.key, end_merge.id)
+    if not end_merge_item then
+        return redis.error_reply("merge plan " .. end_merge.id .. " is not in progress")
+    end
+    local paths = cjson.decode(end_merge_item).paths
+    if type(paths) ~= "table" or #paths == 0 then
+        return redis.error_reply("merge plan " .. end_merge.id .. " has no files")
+    end
+    for _, path in ipairs(paths) do
+        table.insert(merged, {
+            cmd = "DELETE",
+            path = path,
+            database = end_merge.database,
+            table = end_merge.table,
+            layer = end_merge.layer,
+            writer_id = end_merge.writer_id
+        })
+    end
+end
+
 -- Process all files
 local results = {
     processed_count = 0
@@ -194,4 +320,12 @@ for i = 1, #ARGV do
     end
 end
 
+for _, entry in ipairs(merged) do
+    delete_file(entry)
+end
+
+if end_merge_item then
+    redis.call("LREM", options.end_merge.key, 1, end_merge_item)
+end
+
 return results.processed_count
\ No newline at end of file
@@ -3,7 +3,6 @@ package metadata
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -14,21 +13,25 @@ type redisTaskQueue[T Identified] struct {
 	suffix   string
 	writerId string
 	layer    string
+	// leaseSec is how long a handed out entry stays in processing before it
+	// is handed out again
+	leaseSec int64
 
 	getEntrySHA string
+	endEntrySHA string
 	redis       *redis.Client
 }
 
-func (q *redisTaskQueue[T]) processEntry() (T, error) {
+func (q *redisTaskQueue[T]) processEntry(ctx context.Context) (T, error) {
 	var res T
-	eStr, err := q.redis.EvalSha(context.Background(), q.getEntrySHA, []string{
+	eStr, err := q.redis.EvalSha(ctx, q.getEntrySHA, []string{
 		q.prefix,
 		q.database,
 		q.table,
 		q.suffix,
 		q.layer,
 		q.writerId,
-	}, nil).Result()
+	}, q.leaseSec).Result()
 	if err != nil {
 		return res, err
 	}
@@ -41,31 +44,18 @@ func (q *redisTaskQueue[T]) processEntry() (T, error) {
 	return res, err
 }
 
-func (q *redisTaskQueue[T]) finishProcess(entry T) error {
-	suffix := q.suffix
-	if suffix != "" {
-		suffix += ":"
-	}
-	key := fmt.Sprintf("%s:%s:%s:%s%s:%s:processing",
-		q.prefix, q.database, q.table, suffix, q.layer, q.writerId)
-	strQ, err := q.redis.LRange(context.Background(), key, 0, -1).Result()
-	if err != nil {
-		return err
-	}
-	for _, e := range strQ {
-		var _e T
-		err = json.Unmarshal([]byte(e), &_e)
-		if err != nil {
-			fmt.Println("Error unmarshalling entry:", err)
-			continue
-		}
-		if _e.Id() == entry.Id() {
-			_, err := q.redis.LRem(context.Background(), key, 1, e).Result()
-			fmt.Println("Removed entry from processing queue:", _e.Id())
-			return err
-		}
-	}
-	return nil
+// finishProcess removes the entry from the processing list. The lookup and
+// the removal run in one script.
+func (q *redisTaskQueue[T]) finishProcess(ctx context.Context, entry T) error {
+	_, err := q.redis.EvalSha(ctx, q.endEntrySHA, []string{
+		q.prefix,
+		q.database,
+		q.table,
+		q.suffix,
+		q.layer,
+		q.writerId,
+	}, entry.Id()).Result()
+	return err
 }
 
 func (q *redisTaskQueue[T]) AddEntry(entry T) Promise[int32] {
@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"cmp"
+	"context"
+	"iter"
+	"path"
+	"slices"
+	"strings"
+)
+
+// IterationStats are the totals of the files of one merge iteration.
+type IterationStats struct {
+	Files     int64 `json:"files"`
+	SizeBytes int64 `json:"size_bytes"`
+	RowCount  int64 `json:"row_count"`
+}
+
+// Stats are the totals of a set of files. MinTime and MaxTime are 0 if there
+// are no files.
+type Stats struct {
+	Files     int64 `json:"files"`
+	SizeBytes int64 `json:"size_bytes"`
+	RowCount  int64 `json:"row_count"`
+	MinTime   int64 `json:"min_time"`
+	MaxTime   int64 `json:"max_time"`
+	// Iterations breaks the totals down by merge iteration
+	Iterations map[int]IterationStats `json:"iterations"`
+}
+
+func (s *Stats) add(e *IndexEntry) {
+	if s.Files == 0 || e.MinTime < s.MinTime {
+		s.MinTime = e.MinTime
+	}
+	if s.Files == 0 || e.MaxTime > s.MaxTime {
+		s.MaxTime = e.MaxTime
+	}
+	s.Files++
+	s.SizeBytes += e.SizeBytes
+	s.RowCount += e.RowCount
+	if s.Iterations == nil {
+		s.Iterations = make(map[int]IterationStats)
+	}
+	it := s.Iterations[pathIteration(e.Path)]
+	it.Files++
+	it.SizeBytes += e.SizeBytes
+	it.RowCount += e.RowCount
+	s.Iterations[pathIteration(e.Path)] = it
+}
+
+func (s *Stats) merge(o *Stats) {
+	if o.Files == 0 {
+		return
+	}
+	if s.Files == 0 || o.MinTime < s.MinTime {
+		s.MinTime = o.MinTime
+	}
+	if s.Files == 0 || o.MaxTime > s.MaxTime {
+		s.MaxTime = o.MaxTime
+	}
+	s.Files += o.Files
+	s.SizeBytes += o.SizeBytes
+	s.RowCount += o.RowCount
+	if s.Iterations == nil {
+		s.Iterations = make(map[int]IterationStats)
+	}
+	for i, it := range o.Iterations {
+		_it := s.Iterations[i]
+		_it.Files += it.Files
+		_it.SizeBytes += it.SizeBytes
+		_it.RowCount += it.RowCount
+		s.Iterations[i] = _it
+	}
+}
+
+// PartitionStats are the totals of a partition directory of a layer.
+type PartitionStats struct {
+	Layer string `json:"layer"`
+	Path  string `json:"path"`
+	Stats
+}
+
+// LayerStats are the totals of a layer of the table and of its partitions.
+type LayerStats struct {
+	Layer string `json:"layer"`
+	Stats
+	Partitions []*PartitionStats `json:"partitions"`
+}
+
+// TableStats reports the totals of a table per layer, in the order of the
+// layers of the index. Partitions are sorted by path, empty ones are omitted.
+type TableStats interface {
+	Stats() ([]*LayerStats, error)
+	StatsCtx(ctx context.Context) ([]*LayerStats, error)
+}
+
+// layerStats groups the partition totals by layer.
+func layerStats(layers []string, parts []*PartitionStats) []*LayerStats {
+	res := make([]*LayerStats, len(layers))
+	for i, l := range layers {
+		res[i] = &LayerStats{Layer: l, Stats: Stats{Iterations: map[int]IterationStats{}}}
+	}
+	slices.SortFunc(parts, func(a, b *PartitionStats) int {
+		return cmp.Or(strings.Compare(a.Layer, b.Layer), strings.Compare(a.Path, b.Path))
+	})
+	for _, p := range parts {
+		i := slices.Index(layers, p.Layer)
+		if i < 0 || p.Files == 0 {
+			continue
+		}
+		res[i].merge(&p.Stats)
+		res[i].Partitions = append(res[i].Partitions, p)
+	}
+	return res
+}
+
+// statsFromEntries computes the totals of the backends that keep no counters.
+func statsFromEntries(layers []string, entries iter.Seq2[*IndexEntry, error]) ([]*LayerStats, error) {
+	parts := make(map[[2]string]*PartitionStats)
+	for e, err := range entries {
+		if err != nil {
+			return nil, err
+		}
+		k := [2]string{e.Layer, path.Dir(e.Path)}
+		p := parts[k]
+		if p == nil {
+			p = &PartitionStats{Layer: k[0], Path: k[1]}
+			parts[k] = p
+		}
+		p.add(e)
+	}
+	var res []*PartitionStats
+	for _, p := range parts {
+		res = append(res, p)
+	}
+	return layerStats(layers, res), nil
+}
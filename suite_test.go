@@ -0,0 +1,79 @@
+package metadata_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gigapi/metadata"
+	"github.com/gigapi/metadata/metadatatest"
+)
+
+func TestMemIndexSuite(t *testing.T) {
+	storage := metadata.NewMemStorage()
+	metadatatest.RunTableIndexSuite(t, func(t *testing.T, database string, table string,
+		layers []metadata.Layer, options metadata.IndexOptions) metadata.TableIndex {
+		idx, err := metadata.NewMemIndexWithOptions(storage, database, table, layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	})
+}
+
+func TestJSONIndexSuite(t *testing.T) {
+	metadatatest.RunTableIndexSuite(t, jsonFactory(func(o *metadata.IndexOptions) {}))
+}
+
+func TestJSONIndexWALSuite(t *testing.T) {
+	metadatatest.RunTableIndexSuite(t, jsonFactory(func(o *metadata.IndexOptions) {
+		o.Durability = metadata.DurabilityWAL
+	}))
+}
+
+// The changes stay in the delta log, metadata.json is never rewritten
+func TestJSONIndexDeltaSuite(t *testing.T) {
+	metadatatest.RunTableIndexSuite(t, jsonFactory(func(o *metadata.IndexOptions) {
+		o.CheckpointBytes = 1 << 30
+	}))
+}
+
+// Every partition access evicts the previous one
+func TestJSONIndexLRUSuite(t *testing.T) {
+	metadatatest.RunTableIndexSuite(t, jsonFactory(func(o *metadata.IndexOptions) {
+		o.MaxCachedPartitions = 1
+	}))
+}
+
+func jsonFactory(setOptions func(o *metadata.IndexOptions)) metadatatest.Factory {
+	return func(t *testing.T, database string, table string,
+		layers []metadata.Layer, options metadata.IndexOptions) metadata.TableIndex {
+		dir := t.TempDir()
+		for i := range layers {
+			layers[i].URL = "file://" + filepath.Join(dir, layers[i].Name)
+		}
+		setOptions(&options)
+		idx, err := metadata.NewJSONIndexWithOptions(dir, database, table, layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	}
+}
+
+// TestRedisIndexSuite runs against the Redis pointed by REDIS_URL
+// (e.g. redis://localhost:6379/0) and is skipped without it.
+func TestRedisIndexSuite(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	metadatatest.RunTableIndexSuite(t, func(t *testing.T, database string, table string,
+		layers []metadata.Layer, options metadata.IndexOptions) metadata.TableIndex {
+		idx, err := metadata.NewRedisIndexWithOptions(url, database, table, layers, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx
+	})
+}
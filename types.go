@@ -1,12 +1,16 @@
 package metadata
 
 import (
+	"context"
+	"iter"
 	"time"
 )
 
 // MergeConfiguration is array of arrays of:
 // [[timeout_sec, max_size, merge_iteration_id], ...]
-// You have to init MergeConfigurations in the very beginning
+// The configuration is resolved per layer: Layer.MergeConfigurations first,
+// then IndexOptions.MergeConfigurations of the table, then the global
+// MergeConfigurations.
 type MergeConfigurationsConf [3]int64
 
 func (m MergeConfigurationsConf) TimeoutSec() int64 {
@@ -21,6 +25,11 @@ func (m MergeConfigurationsConf) MergeIterationId() int64 {
 	return m[2]
 }
 
+// MergeConfigurations is the process wide fallback used by the indexes
+// created without an explicit merge configuration.
+//
+// Deprecated: pass IndexOptions.MergeConfigurations or set
+// Layer.MergeConfigurations instead.
 var MergeConfigurations []MergeConfigurationsConf
 
 type Layer struct {
@@ -28,6 +37,131 @@ type Layer struct {
 	Name   string `json:"name"`
 	Type   string `json:"type"`
 	TTLSec int32  `json:"ttl_sec"`
+	// MergeConfigurations overrides the merge ladder of the table for this layer
+	MergeConfigurations []MergeConfigurationsConf `json:"merge_configurations,omitempty"`
+}
+
+const (
+	defaultDropDelay    = 30 * time.Second
+	defaultLeaseTimeout = 30 * time.Minute
+)
+
+// Durability is how the JSON backend persists a Batch before resolving its
+// promise.
+type Durability int
+
+const (
+	// DurabilityNone resolves the promise once metadata.json is rewritten,
+	// without syncing it to the disk
+	DurabilityNone Durability = iota
+	// DurabilityFsync also syncs metadata.json and its directory
+	DurabilityFsync
+	// DurabilityWAL resolves the promise once the batch is appended and synced
+	// to the write-ahead log of the partition. metadata.json is rewritten and
+	// synced in background, the log is replayed at startup.
+	DurabilityWAL
+)
+
+// Codec is the encoding of the partition files written by the JSON backend.
+// The files of every codec are recognized and read whatever the codec of the
+// index.
+type Codec int
+
+const (
+	// CodecJSON is plain JSON
+	CodecJSON Codec = iota
+	// CodecGzip is gzip compressed JSON
+	CodecGzip
+	// CodecBinary is a JSON header followed by a length-prefixed binary
+	// record per file
+	CodecBinary
+)
+
+// IndexOptions holds the per-table settings of a TableIndex.
+type IndexOptions struct {
+	MergeConfigurations []MergeConfigurationsConf
+	// DropDelay is the grace period before a removed file is handed out by
+	// the drop planner, 30s by default. It has a one second resolution.
+	DropDelay time.Duration
+	// LeaseTimeout is how long a handed out plan stays hidden from the
+	// planners before it is handed out again, 30 minutes by default. The JSON
+	// and Redis backends have a one second resolution.
+	LeaseTimeout time.Duration
+	// Durability of the writes, JSON backend only
+	Durability Durability
+	// MaxCachedPartitions and MaxCachedBytes bound the partitions the JSON
+	// backend keeps in memory, 0 means no bound. With a bound the partitions
+	// are loaded on demand and the least recently used ones are flushed and
+	// unloaded. MaxCachedBytes is measured on the serialized entries.
+	MaxCachedPartitions int
+	MaxCachedBytes      int64
+	// RefreshInterval makes a running JSON index poll the disk for the
+	// partitions changed or created by other processes, 0 disables it
+	RefreshInterval time.Duration
+	// PartitionScheme is the layout of the partition directories,
+	// DefaultPartitionScheme if nil
+	PartitionScheme PartitionScheme
+	// CheckpointBytes makes the JSON backend append the changes of a flush
+	// to the log of the partition and rewrite metadata.json only once the
+	// log outgrows it. 0 rewrites metadata.json on every flush.
+	CheckpointBytes int64
+	// Codec of the partition files of the JSON backend, CodecJSON by default
+	Codec Codec
+	// StrictFormat makes the JSON backend fail on the fields of metadata.json
+	// it does not know instead of skipping them
+	StrictFormat bool
+	// OnError receives the errors of the background work of the JSON
+	// backend nobody waits for: flushes, refreshes, unloads and manifest
+	// writes. They are dropped if nil.
+	OnError func(err error)
+}
+
+func (o *IndexOptions) partitionScheme() PartitionScheme {
+	if o.PartitionScheme == nil {
+		return DefaultPartitionScheme
+	}
+	return o.PartitionScheme
+}
+
+// onError reports an error of the background work.
+func (o *IndexOptions) onError(err error) {
+	if err != nil && o.OnError != nil {
+		o.OnError(err)
+	}
+}
+
+// boundedCache tells if the JSON backend loads the partitions on demand.
+func (o *IndexOptions) boundedCache() bool {
+	return o.MaxCachedPartitions > 0 || o.MaxCachedBytes > 0
+}
+
+func (o *IndexOptions) dropDelaySec() int64 {
+	if o.DropDelay == 0 {
+		return int64(defaultDropDelay / time.Second)
+	}
+	return int64(o.DropDelay / time.Second)
+}
+
+func (o *IndexOptions) leaseTimeout() time.Duration {
+	if o.LeaseTimeout == 0 {
+		return defaultLeaseTimeout
+	}
+	return o.LeaseTimeout
+}
+
+func (o *IndexOptions) leaseTimeoutSec() int64 {
+	return int64(o.leaseTimeout() / time.Second)
+}
+
+// mergeConfigurations returns the merge ladder for the layer.
+func (o *IndexOptions) mergeConfigurations(layer *Layer) []MergeConfigurationsConf {
+	if layer != nil && len(layer.MergeConfigurations) > 0 {
+		return layer.MergeConfigurations
+	}
+	if len(o.MergeConfigurations) > 0 {
+		return o.MergeConfigurations
+	}
+	return MergeConfigurations
 }
 
 type IndexEntry struct {
@@ -50,6 +184,28 @@ type QueryOptions struct {
 	After     time.Time
 	Before    time.Time
 	Iteration int
+	// Keys restricts the result to the partitions with these values of the
+	// keys of the PartitionScheme, e.g. {"tenant": "acme"}
+	Keys map[string]string
+	// Filter prunes the files whose column statistics cannot match
+	Filter Predicate
+	// Layers and WriterIDs restrict the result to the listed values if set
+	Layers    []string
+	WriterIDs []string
+	// Size and row count bounds are inclusive, 0 means no bound
+	MinSizeBytes int64
+	MaxSizeBytes int64
+	MinRowCount  int64
+	MaxRowCount  int64
+	// OrderBy sorts the result. The order is total: the ties are broken by
+	// path and layer.
+	OrderBy    OrderBy
+	Descending bool
+	// Limit caps the number of entries, 0 means no limit
+	Limit int
+	// Cursor resumes an ordered query after the last entry of the previous
+	// page, see QueryPage
+	Cursor string
 }
 
 type Identified interface {
@@ -87,23 +243,30 @@ func (m MovePlan) Id() string {
 }
 
 type DropPlan struct {
-	ID       string
-	WriterID string
-	Layer    string
-	Database string
-	Table    string
-	Path     string
-	TimeS    int32
+	ID       string `json:"id"`
+	WriterID string `json:"writer_id"`
+	Layer    string `json:"layer"`
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Path     string `json:"path"`
+	TimeS    int32  `json:"time_s"`
 }
 
 func (d DropPlan) Id() string {
 	return d.ID
 }
 
+// KVStoreIndex, DBIndex and the table level interfaces below come in two
+// flavours: the plain methods run with context.Background() and are kept for
+// compatibility, the *Ctx variants let the caller bound the underlying
+// Redis round-trips, Lua evaluation and directory walks.
 type KVStoreIndex interface {
 	Get(key string) ([]byte, error)
 	Put(key string, value []byte) error
 	Delete(key string) error
+	GetCtx(ctx context.Context, key string) ([]byte, error)
+	PutCtx(ctx context.Context, key string, value []byte) error
+	DeleteCtx(ctx context.Context, key string) error
 	Destroy()
 }
 
@@ -111,35 +274,75 @@ type DBIndex interface {
 	Databases() ([]string, error)
 	Tables(database string) ([]string, error)
 	Paths(database string, table string) ([]string, error)
+	DatabasesCtx(ctx context.Context) ([]string, error)
+	TablesCtx(ctx context.Context, database string) ([]string, error)
+	PathsCtx(ctx context.Context, database string, table string) ([]string, error)
 }
 
 type TableIndex interface {
 	Batch(add []*IndexEntry, rm []*IndexEntry) Promise[int32]
+	BatchCtx(ctx context.Context, add []*IndexEntry, rm []*IndexEntry) Promise[int32]
 	Get(layer string, path string) *IndexEntry
+	GetCtx(ctx context.Context, layer string, path string) *IndexEntry
 	Run()
 	Stop()
 	GetMergePlanner() TableMergePlanner
 	GetQuerier() TableQuerier
 	GetMovePlanner() TableMovePlanner
 	GetDropPlanner() TableDropPlanner
+	GetStats() TableStats
 	GetAll() ([]*IndexEntry, error)
+	GetAllCtx(ctx context.Context) ([]*IndexEntry, error)
+	// GetAllIter streams every entry of the table without loading the whole
+	// table in memory. An error stops the iteration and is yielded with a nil
+	// entry.
+	GetAllIter(ctx context.Context) iter.Seq2[*IndexEntry, error]
 }
 
 type TableDropPlanner interface {
 	GetDropQueue(writerId string, layer string) (DropPlan, error)
 	RmFromDropQueue(plan DropPlan) Promise[int32]
+	GetDropQueueCtx(ctx context.Context, writerId string, layer string) (DropPlan, error)
+	RmFromDropQueueCtx(ctx context.Context, plan DropPlan) Promise[int32]
 }
 
 type TableMergePlanner interface {
 	GetMergePlan(writerId string, layer string, iteration int) (MergePlan, error)
 	EndMerge(plan MergePlan) Promise[int32]
+	GetMergePlanCtx(ctx context.Context, writerId string, layer string, iteration int) (MergePlan, error)
+	EndMergeCtx(ctx context.Context, plan MergePlan) Promise[int32]
+	// CommitMerge replaces the From files of the plan with the merged result,
+	// queues them for dropping and ends the plan in one step. Readers see
+	// either the source files or the result, never both or neither. It fails
+	// and changes nothing if the plan is not in progress.
+	CommitMerge(plan MergePlan, result *IndexEntry) Promise[int32]
+	CommitMergeCtx(ctx context.Context, plan MergePlan, result *IndexEntry) Promise[int32]
 }
 
 type TableMovePlanner interface {
 	GetMovePlan(writerId string, layer string) (MovePlan, error)
 	EndMove(plan MovePlan) Promise[int32]
+	GetMovePlanCtx(ctx context.Context, writerId string, layer string) (MovePlan, error)
+	EndMoveCtx(ctx context.Context, plan MovePlan) Promise[int32]
 }
 
 type TableQuerier interface {
 	Query(options QueryOptions) ([]*IndexEntry, error)
+	QueryCtx(ctx context.Context, options QueryOptions) ([]*IndexEntry, error)
+	// QueryIter streams the matching entries partition by partition. Breaking
+	// out of the loop stops the scan. An error stops the iteration and is
+	// yielded with a nil entry.
+	QueryIter(ctx context.Context, options QueryOptions) iter.Seq2[*IndexEntry, error]
+}
+
+// collectEntries drains an entry iterator into a slice.
+func collectEntries(seq iter.Seq2[*IndexEntry, error]) ([]*IndexEntry, error) {
+	var res []*IndexEntry
+	for e, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, nil
 }